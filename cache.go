@@ -0,0 +1,99 @@
+package mustache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultParseCacheSize is the number of templates a parse cache holds unless WithParseCacheSize sets another size.
+const defaultParseCacheSize = 1000
+
+// WithParseCache sets whether CompileString keeps the templates it compiles, so that compiling the same source again
+// returns the same *Template instead of parsing it again. Setting any other option empties the cache. Templates which
+// fail to compile, and those compiled by CompileFile and CompileFS, are not cached.
+func (r *Compiler) WithParseCache(b bool) *Compiler {
+	if !b {
+		r.cache = nil
+	} else if r.cache == nil {
+		r.cache = newParseCache(r.cacheSize)
+	}
+	return r
+}
+
+// WithParseCacheSize sets the number of templates kept by the cache turned on by WithParseCache, discarding the least
+// recently used first once it is full. It empties the cache. A size of 0 or less sets the default size of 1000.
+func (r *Compiler) WithParseCacheSize(n int) *Compiler {
+	r.cacheSize = n
+	if r.cache != nil {
+		r.cache = newParseCache(n)
+	}
+	return r
+}
+
+// optionsChanged empties the parse cache, if there is one, when an option of the compiler is set, since the templates
+// in it were compiled with the options as they were before.
+func (r *Compiler) optionsChanged() {
+	if r.cache != nil {
+		r.cache.clear()
+	}
+}
+
+// A parseCache holds the most recently used templates compiled from source strings, by their source.
+type parseCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // The entries from the most to the least recently used
+}
+
+type parseCacheEntry struct {
+	data string
+	tmpl *Template
+}
+
+func newParseCache(size int) *parseCache {
+	if size <= 0 {
+		size = defaultParseCacheSize
+	}
+	return &parseCache{size: size, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// clear removes all the templates from the cache.
+func (c *parseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// get returns the cached template compiled from the source, or compiles and caches it if there is none.
+func (c *parseCache) get(data string, compile func(string) (*Template, error)) (*Template, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[data]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*parseCacheEntry).tmpl, nil
+	}
+	c.mu.Unlock()
+
+	// The lock isn't held while compiling, so two goroutines may compile the same source at once; the first to finish
+	// is kept.
+	tmpl, err := compile(data)
+	if err != nil {
+		return tmpl, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[data]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*parseCacheEntry).tmpl, nil
+	}
+	c.entries[data] = c.order.PushFront(&parseCacheEntry{data, tmpl})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*parseCacheEntry).data)
+	}
+	return tmpl, nil
+}
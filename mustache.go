@@ -2,25 +2,109 @@ package mustache
 
 import (
 	"bytes"
+	"database/sql/driver"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // RenderFn is the signature of a function which can be called from a lambda section
 type RenderFn func(text string) (string, error)
 
+// BlockRenderFn renders the body of a block helper, or the part after its {{else}} tag, with the current context. If
+// data is given, it is pushed on to the context first, so that it can be referred to as {{.}}.
+type BlockRenderFn func(data ...interface{}) (string, error)
+
+// BlockHelperFn implements a block helper registered with WithBlockHelpers. It is given the tag's arguments, the
+// current context, and functions to render the body and the {{else}} part, which is empty if there isn't one. The
+// string it returns is written without escaping.
+type BlockHelperFn func(args []interface{}, context interface{}, body, inverse BlockRenderFn) (string, error)
+
 type Compiler struct {
 	partial        PartialProvider
 	outputMode     EscapeMode
 	errorOnMissing bool
+	missingPartial func(name string) string
+	lineEndings    LineEndingMode
+	logger         Logger
+	extModes       map[string]EscapeMode
+	escapeFunc     EscapeFunc
+	tagEscapeFunc  TagEscapeFunc
+	maxOutput      int64
+	trimValues     bool
+	wsTruthy       bool
+	layoutSlot     string
+	passthrough    bool
+	zeroTruthy     bool
+	sanitizer      func(string) string
+	truthyFunc     func(value interface{}) bool
+	pluralRule     PluralRule
+	disallowRaw    bool
+	boolStrings    []string
+	strictTypes    bool
+	htmlEscaper    *strings.Replacer
+	preserveBOM    bool
+	blockHelpers   map[string]BlockHelperFn
+	stdHelpers     bool
+	funcs          map[string]reflect.Value
+	validateUTF8   bool
+	numThreshold   *float64
+	limits         CompileLimits
+	maxIterations  int
+	sectionFilters map[string]func(interface{}) bool
+	trimNewline    bool
+	namespaces     map[string]interface{}
+	typeStringers  map[reflect.Type]TypeStringer
+	trimComments   bool
+	beforePartial  func(string) error
+	afterPartial   func(string) error
+	preprocessor   func(name, source string) (string, error)
+	cache          *parseCache
+	cacheSize      int
+	indentTabWidth int
+	resolver       func(interface{}, string) (interface{}, bool)
+	collectMissing bool
+	mapMode        MapSectionMode
+	maxContext     int
+	strictInvert   bool
+}
+
+// CompileLimits limits the size and complexity of the templates a Compiler accepts, for templates from untrusted
+// sources. A limit of zero means no limit.
+type CompileLimits struct {
+	MaxBytes int // The maximum size of a template's source, in bytes
+	MaxTags  int // The maximum number of tags in a template, including comments and set delimiter tags
+	MaxDepth int // The maximum depth of nested sections
 }
 
+// ErrOutputTooLarge is returned when rendering a template would produce more output than the limit set with
+// WithMaxOutputBytes.
+var ErrOutputTooLarge = errors.New("mustache: output too large")
+
+// ErrIterationLimitExceeded is returned when a section iterates over more elements than the limit set with
+// WithMaxIterations.
+var ErrIterationLimitExceeded = errors.New("mustache: iteration limit exceeded")
+
+// ErrContextTooDeep is returned when sections are nested, through partials or otherwise, more deeply than the limit set
+// with WithMaxContextDepth.
+var ErrContextTooDeep = errors.New("mustache: context too deep")
+
 func New() *Compiler {
 	return &Compiler{}
 }
@@ -28,41 +112,617 @@ func New() *Compiler {
 // WithPartials adds a partial provider and enables support for partials.
 func (r *Compiler) WithPartials(pp PartialProvider) *Compiler {
 	r.partial = pp
+	r.optionsChanged()
 	return r
 }
 
-// WithEscapeMode sets the output mode to either HTML, JSON or raw (plain text).
+// WithEscapeMode sets the output mode to either HTML, HTML attribute values, JSON or raw (plain text).
 // The default is HTML.
 func (r *Compiler) WithEscapeMode(m EscapeMode) *Compiler {
 	r.outputMode = m
+	r.optionsChanged()
+	return r
+}
+
+// WithEscapeFunc sets a function used to escape the values of {{name}} tags, in place of the escaping performed by
+// the escape mode. Values of {{{name}}} and {{&name}} tags are not escaped.
+func (r *Compiler) WithEscapeFunc(fn EscapeFunc) *Compiler {
+	r.escapeFunc = fn
+	r.optionsChanged()
+	return r
+}
+
+// WithEscapeSet sets the values of {{name}} tags to be escaped by replacing each of the runes in the map with its
+// replacement, leaving everything else as it is. It is a shorthand for WithEscapeFunc, which it replaces.
+func (r *Compiler) WithEscapeSet(set map[rune]string) *Compiler {
+	oldnew := make([]string, 0, 2*len(set))
+	for c, repl := range set {
+		oldnew = append(oldnew, string(c), repl)
+	}
+	replacer := strings.NewReplacer(oldnew...)
+	r.escapeFunc = func(w io.Writer, s string) error {
+		_, err := replacer.WriteString(w, s)
+		return err
+	}
+	r.optionsChanged()
+	return r
+}
+
+// WithTagEscapeFunc sets a function used to write the value of every tag to the output, including {{{name}}} and
+// {{&name}} tags, so that it can decide how to escape each one. It takes precedence over WithEscapeFunc and the
+// escape mode.
+func (r *Compiler) WithTagEscapeFunc(fn TagEscapeFunc) *Compiler {
+	r.tagEscapeFunc = fn
+	r.optionsChanged()
+	return r
+}
+
+// WithMaxOutputBytes limits the output of rendering a template to n bytes. If rendering would produce more, it is
+// aborted with ErrOutputTooLarge once the first n bytes have been written. The default of 0 means no limit.
+func (r *Compiler) WithMaxOutputBytes(n int64) *Compiler {
+	r.maxOutput = n
+	r.optionsChanged()
+	return r
+}
+
+// WithTrimValues sets whether leading and trailing whitespace is trimmed from string values before they are
+// interpolated. It applies to both escaped {{var}} and raw {{{var}}} tags, and leaves values which aren't strings,
+// such as numbers and structs, alone.
+func (r *Compiler) WithTrimValues(b bool) *Compiler {
+	r.trimValues = b
+	r.optionsChanged()
+	return r
+}
+
+// WithWhitespaceTruthy sets whether a string consisting only of whitespace is treated as true by sections, as it
+// is in most other Mustache implementations. By default such strings are false, like the empty string. Whitespace
+// is as defined by unicode.IsSpace, so it includes spaces, tabs, newlines and Unicode spaces such as U+00A0.
+func (r *Compiler) WithWhitespaceTruthy(b bool) *Compiler {
+	r.wsTruthy = b
+	r.optionsChanged()
+	return r
+}
+
+// WithLayoutSlot sets the name of the variable which templates compiled for use as layouts use to include the
+// output of the template they wrap. The default is "content".
+func (r *Compiler) WithLayoutSlot(name string) *Compiler {
+	r.layoutSlot = name
+	r.optionsChanged()
+	return r
+}
+
+// WithPassthroughMissing sets whether variables and sections which can't be found in the context are written to the
+// output as they appear in the template, so that it can be rendered again with other data. This takes precedence over
+// WithErrors.
+func (r *Compiler) WithPassthroughMissing(b bool) *Compiler {
+	r.passthrough = b
+	r.optionsChanged()
+	return r
+}
+
+// WithZeroTruthy sets whether numbers equal to zero, of any integer or floating point type, are treated as true by
+// sections, so that {{#count}}{{.}}{{/count}} renders 0. By default, as with Go's zero values, they are false. Nil,
+// empty strings and empty lists are false either way.
+func (r *Compiler) WithZeroTruthy(b bool) *Compiler {
+	r.zeroTruthy = b
+	r.optionsChanged()
+	return r
+}
+
+// WithSanitizer sets a function, such as an HTML sanitizer, through which values in {{safe name}} tags are passed.
+// Its result is written without further escaping. Without a sanitizer, {{safe name}} is escaped like {{name}}.
+func (r *Compiler) WithSanitizer(fn func(string) string) *Compiler {
+	r.sanitizer = fn
+	r.optionsChanged()
+	return r
+}
+
+// WithTruthyFunc sets a function which decides whether the value of a section, or nil if it is missing, is true, in
+// place of all of the built-in rules. Lists are still iterated over when it returns true.
+func (r *Compiler) WithTruthyFunc(fn func(value interface{}) bool) *Compiler {
+	r.truthyFunc = fn
+	r.optionsChanged()
+	return r
+}
+
+// WithNumericSectionThreshold sets the number which a numeric value must be greater than to be truthy, so that
+// {{#score}}...{{/score}} renders only for high enough scores. It affects only values of numeric kinds; zero is still
+// truthy if WithZeroTruthy is set. By default any number other than zero is truthy.
+func (r *Compiler) WithNumericSectionThreshold(n float64) *Compiler {
+	r.numThreshold = &n
+	r.optionsChanged()
+	return r
+}
+
+// WithCompileLimits sets limits on the size and complexity of the templates compiled, including partials. Compiling a
+// template which exceeds any of them is an error, returned as soon as the limit is reached.
+func (r *Compiler) WithCompileLimits(limits CompileLimits) *Compiler {
+	r.limits = limits
+	r.optionsChanged()
+	return r
+}
+
+// WithMaxIterations limits the number of elements a section may iterate over to n, failing the render with
+// ErrIterationLimitExceeded beyond it. The default of 0 means no limit.
+func (r *Compiler) WithMaxIterations(n int) *Compiler {
+	r.maxIterations = n
+	r.optionsChanged()
+	return r
+}
+
+// WithSectionFilter sets a function which chooses the elements of a list that sections and each blocks with the given
+// name, as written in the tag, render. If it rejects them all, the inverted section or {{else}} part is rendered.
+func (r *Compiler) WithSectionFilter(name string, fn func(elem interface{}) bool) *Compiler {
+	// copy the map, so that templates already compiled keep the filters they were compiled with
+	filters := make(map[string]func(interface{}) bool, len(r.sectionFilters)+1)
+	for n, f := range r.sectionFilters {
+		filters[n] = f
+	}
+	filters[name] = fn
+	r.sectionFilters = filters
+	r.optionsChanged()
+	return r
+}
+
+// WithContextNamespace makes data available to templates under the reserved name @name, as in {{@ctx.currentUser}},
+// for values such as the current user which are needed alongside the data being rendered. Names starting with @name
+// are looked up only in data, so the data being rendered can't shadow them.
+func (r *Compiler) WithContextNamespace(name string, data interface{}) *Compiler {
+	// copy the map, so that templates already compiled keep the namespaces they were compiled with
+	namespaces := make(map[string]interface{}, len(r.namespaces)+1)
+	for ns, d := range r.namespaces {
+		namespaces[ns] = d
+	}
+	namespaces[strings.TrimPrefix(name, "@")] = data
+	r.namespaces = namespaces
+	r.optionsChanged()
+	return r
+}
+
+// WithConstants makes string constants, such as build metadata, available to templates as {{@const.name}}, where the
+// data being rendered can't override them. Calling it again adds to the constants, replacing those with the same names.
+func (r *Compiler) WithConstants(constants map[string]string) *Compiler {
+	merged := map[string]string{}
+	if prev, ok := r.namespaces[constNamespace].(map[string]string); ok {
+		for name, value := range prev {
+			merged[name] = value
+		}
+	}
+	for name, value := range constants {
+		merged[name] = value
+	}
+	return r.WithContextNamespace(constNamespace, merged)
+}
+
+// constNamespace is the namespace of the constants set with WithConstants.
+const constNamespace = "const"
+
+// A TypeStringer formats a value of a particular type for interpolation, and reports whether it is present: if not,
+// it renders nothing, and is false in sections.
+type TypeStringer func(value interface{}) (s string, present bool)
+
+// WithTypeStringer sets the functions which format values of the given types, and pointers to them, in place of the
+// usual formatting, and decide whether they are true in sections. Calling it again adds to the functions already set.
+func (r *Compiler) WithTypeStringer(stringers map[reflect.Type]TypeStringer) *Compiler {
+	// copy the map, so that templates already compiled keep the functions they were compiled with
+	all := make(map[reflect.Type]TypeStringer, len(r.typeStringers)+len(stringers))
+	for t, fn := range r.typeStringers {
+		all[t] = fn
+	}
+	for t, fn := range stringers {
+		all[t] = fn
+	}
+	r.typeStringers = all
+	r.optionsChanged()
+	return r
+}
+
+// WithAutoTrimStandaloneComments sets whether a line which holds only comments and whitespace is removed, including its
+// newline, even if it has more than one comment on it, as in {{! one }}{{! two }}. A line with a single comment on it
+// is removed in any case, as the Mustache spec requires. Other tags are unaffected.
+func (r *Compiler) WithAutoTrimStandaloneComments(b bool) *Compiler {
+	r.trimComments = b
+	r.optionsChanged()
+	return r
+}
+
+// WithPartialHooks sets functions called with the name of each partial a template includes, before it is fetched and
+// after it has been rendered. An error from either stops the render. Either may be nil.
+func (r *Compiler) WithPartialHooks(before, after func(name string) error) *Compiler {
+	r.beforePartial = before
+	r.afterPartial = after
+	r.optionsChanged()
+	return r
+}
+
+// WithPartialPreprocessor sets a function which rewrites the source of each partial before it is compiled, given the
+// name the partial was included by and its unindented source. An error from it stops the render, even without
+// WithErrors.
+func (r *Compiler) WithPartialPreprocessor(fn func(name, source string) (string, error)) *Compiler {
+	r.preprocessor = fn
+	r.optionsChanged()
+	return r
+}
+
+// WithPartialIndentTabWidth sets the width of a tab in the indentation before a standalone partial tag, so that the
+// tabs are expanded to spaces before the partial's lines are indented. By default, or if it is 0, they are kept.
+func (r *Compiler) WithPartialIndentTabWidth(width int) *Compiler {
+	r.indentTabWidth = width
+	r.optionsChanged()
+	return r
+}
+
+// WithNameResolver sets a function which maps names in templates to values, for lookup rules of your own. It is tried
+// for each value in the context before the usual lookup, which is used if it reports that it has no value.
+func (r *Compiler) WithNameResolver(fn func(context interface{}, name string) (interface{}, bool)) *Compiler {
+	r.resolver = fn
+	r.optionsChanged()
+	return r
+}
+
+// WithCollectMissing sets whether the variables missing from the context are collected as a template is rendered,
+// rather than stopping the render at the first one as WithErrors does. Once the render is complete, the errors for all
+// of them are returned together.
+func (r *Compiler) WithCollectMissing(b bool) *Compiler {
+	r.collectMissing = b
+	r.optionsChanged()
+	return r
+}
+
+// WithMapSectionMode sets how a section renders when its value is a map: pushed onto the context once with AsContext,
+// the default, or once for each entry, in order of key, with AsPairs.
+func (r *Compiler) WithMapSectionMode(mode MapSectionMode) *Compiler {
+	r.mapMode = mode
+	r.optionsChanged()
+	return r
+}
+
+// WithMaxContextDepth limits the number of values sections may push onto the context, one inside another, to n, so
+// that rendering fails with ErrContextTooDeep beyond it. The default of 0 means no limit.
+func (r *Compiler) WithMaxContextDepth(n int) *Compiler {
+	r.maxContext = n
+	r.optionsChanged()
+	return r
+}
+
+// WithInvertedRequiresPresence sets whether an inverted section such as {{^admin}} renders only for a value which is
+// present in the context but false or empty, rather than also for a missing value as the spec has it. A missing value
+// then renders nothing, or fails the render if WithErrors is set.
+func (r *Compiler) WithInvertedRequiresPresence(b bool) *Compiler {
+	r.strictInvert = b
+	r.optionsChanged()
+	return r
+}
+
+// WithPluralRule sets the rule by which the plural helper chooses between forms of a word, for languages other than
+// English. The default is EnglishPlural.
+func (r *Compiler) WithPluralRule(rule PluralRule) *Compiler {
+	r.pluralRule = rule
+	r.optionsChanged()
+	return r
+}
+
+// WithDisallowRaw sets whether raw {{{name}}} and {{&name}} tags are forbidden, so that every value interpolated into
+// a template is escaped. If so, compiling a template which contains one fails. The default allows them.
+func (r *Compiler) WithDisallowRaw(b bool) *Compiler {
+	r.disallowRaw = b
+	r.optionsChanged()
+	return r
+}
+
+// WithBoolFormat sets the text that true and false boolean values are interpolated as, such as "1" and "0". The
+// default is "true" and "false". Boolean types with a String method are not affected.
+func (r *Compiler) WithBoolFormat(trueStr, falseStr string) *Compiler {
+	r.boolStrings = []string{trueStr, falseStr}
+	r.optionsChanged()
+	return r
+}
+
+// WithStrictTypes sets whether interpolating a struct, map, slice, array, function or channel is an error, rather than
+// writing it with Go's default formatting, which is rarely what was meant. Values of these kinds which implement
+// fmt.Stringer, encoding.TextMarshaler or error are still allowed, as is anything in JSON mode.
+func (r *Compiler) WithStrictTypes(b bool) *Compiler {
+	r.strictTypes = b
+	r.optionsChanged()
+	return r
+}
+
+// WithHTMLEscapeChars limits the escaping of {{name}} tags in HTML mode to the characters in chars, such as "<>" to
+// leave ampersands and quotes as they are. Each is replaced by the same entity as html/template uses, or by a numeric
+// character reference if it is not one of the characters HTML needs escaped. By default, &<>"' are escaped.
+func (r *Compiler) WithHTMLEscapeChars(chars string) *Compiler {
+	oldnew := []string{}
+	for _, c := range chars {
+		entity, ok := htmlEntities[c]
+		if !ok {
+			entity = fmt.Sprintf("&#%d;", c)
+		}
+		oldnew = append(oldnew, string(c), entity)
+	}
+	r.htmlEscaper = strings.NewReplacer(oldnew...)
+	r.optionsChanged()
+	return r
+}
+
+// WithValidateUTF8 sets whether compiling a template whose source is not valid UTF-8 is an error, giving the byte
+// offset of the first invalid sequence, to catch files saved in the wrong encoding. By default any bytes are accepted.
+func (r *Compiler) WithValidateUTF8(b bool) *Compiler {
+	r.validateUTF8 = b
+	r.optionsChanged()
+	return r
+}
+
+// htmlEntities are the replacements html/template uses for the characters it escapes.
+var htmlEntities = map[rune]string{
+	'&':  "&amp;",
+	'<':  "&lt;",
+	'>':  "&gt;",
+	'"':  "&#34;",
+	'\'': "&#39;",
+}
+
+// WithTrimTrailingNewline sets whether a single newline, "\n" or "\r\n", at the end of a template compiled from a file
+// is removed before it is parsed, for output such as a line of CSV which shouldn't end with the newline editors add to
+// the files they save. Templates compiled from strings, and partials, are unaffected. By default the newline is kept.
+func (r *Compiler) WithTrimTrailingNewline(b bool) *Compiler {
+	r.trimNewline = b
+	r.optionsChanged()
+	return r
+}
+
+// WithPreserveBOM sets whether a UTF-8 byte order mark at the start of a template is kept as part of its text. By
+// default it is removed, as some editors add one to the files they save.
+func (r *Compiler) WithPreserveBOM(b bool) *Compiler {
+	r.preserveBOM = b
+	r.optionsChanged()
+	return r
+}
+
+// WithBlockHelpers registers block helpers by name, adding to any registered before. A section tag whose first word
+// is the name of a block helper, such as {{#repeat 3}}, calls the helper instead of looking up the name, and may
+// contain an {{else}} tag. The built-in helpers with, each, fields and define cannot be replaced.
+func (r *Compiler) WithBlockHelpers(helpers map[string]BlockHelperFn) *Compiler {
+	// copy the map, so that templates already compiled keep the helpers they were compiled with
+	blockHelpers := make(map[string]BlockHelperFn, len(r.blockHelpers)+len(helpers))
+	for name, fn := range r.blockHelpers {
+		blockHelpers[name] = fn
+	}
+	for name, fn := range helpers {
+		blockHelpers[name] = fn
+	}
+	r.blockHelpers = blockHelpers
+	r.optionsChanged()
+	return r
+}
+
+// WithStandardHelpers enables the if and unless block helpers. {{#if name}}...{{else}}...{{/if}} renders its body if
+// the value is truthy, by the same rules as a section, and the part after {{else}} if not, without changing the
+// context. {{#unless name}} is the reverse.
+func (r *Compiler) WithStandardHelpers() *Compiler {
+	r.stdHelpers = true
+	r.optionsChanged()
+	return r
+}
+
+// WithFuncs registers functions, given as a text/template FuncMap, which can be called in variable tags as in
+// {{name arg...}}. Functions take precedence over data with the same name, but not over the built-in helpers.
+// WithFuncs panics if a value is not a suitable function, as Funcs does.
+func (r *Compiler) WithFuncs(funcs map[string]interface{}) *Compiler {
+	// copy the map, so that templates already compiled keep the functions they were compiled with
+	all := make(map[string]reflect.Value, len(r.funcs)+len(funcs))
+	for name, v := range r.funcs {
+		all[name] = v
+	}
+	for name, fn := range funcs {
+		v := reflect.ValueOf(fn)
+		if v.Kind() != reflect.Func {
+			panic("mustache: value for " + name + " is not a function")
+		}
+		if n := v.Type().NumOut(); n == 0 || n > 2 || n == 2 && v.Type().Out(1) != errorType {
+			panic(fmt.Sprintf("mustache: function %s must return one value, or two with the second an error", name))
+		}
+		all[name] = v
+	}
+	r.funcs = all
+	r.optionsChanged()
+	return r
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// WithEscapeByExtension sets escape modes to use for templates compiled from files with the given extensions, such as
+// ".json" or ".txt", overriding the mode set by WithEscapeMode. It applies to CompileFile and CompileFS; partials
+// are always rendered with the escape mode of the template which includes them.
+func (r *Compiler) WithEscapeByExtension(modes map[string]EscapeMode) *Compiler {
+	r.extModes = modes
+	r.optionsChanged()
 	return r
 }
 
 // WithErrors enables errors when there is a missing data object referred to by the template, a missing partial,
 // or a missing partial provider to handle a partial. Otherwise, errors are ignored and result in empty strings in the
-// output.
+// output. An inverted section over a missing value is rendered, without an error.
 func (r *Compiler) WithErrors(b bool) *Compiler {
 	r.errorOnMissing = b
+	r.optionsChanged()
+	return r
+}
+
+// WithMissingPartialPlaceholder sets a function which is called when errors are enabled and a partial cannot be
+// found. Rather than aborting the render, the string it returns for the partial's name is written to the output in
+// place of the partial. Other errors from the partial provider still abort the render.
+func (r *Compiler) WithMissingPartialPlaceholder(fn func(name string) string) *Compiler {
+	r.missingPartial = fn
+	r.optionsChanged()
+	return r
+}
+
+// WithLineEndings sets how line endings in the literal text of the template are written to the output. The default,
+// Preserve, writes them exactly as they appear in the template; LF and CRLF convert all line endings in the template
+// text to "\n" or "\r\n" respectively. Values interpolated into the template are never altered.
+func (r *Compiler) WithLineEndings(m LineEndingMode) *Compiler {
+	r.lineEndings = m
+	r.optionsChanged()
+	return r
+}
+
+// A Logger receives the diagnostic events set up with WithLogger. A Logger is one, with the Go versions which
+// have log/slog: each event is a message followed by alternating keys and values.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// WithLogger sets a logger to which diagnostic events are written at debug level as templates are compiled and
+// rendered: changes of delimiters, partials fetched from the partial provider, variables and sections missing from
+// the context, and calls to lambdas. Nothing is logged by default, or if the logger is a nil pointer.
+func (r *Compiler) WithLogger(l Logger) *Compiler {
+	r.logger = l
+	if v := reflect.ValueOf(l); v.Kind() == reflect.Ptr && v.IsNil() {
+		r.logger = nil
+	}
+	r.optionsChanged()
 	return r
 }
 
 // CompileString compiles a Mustache template from a string.
 func (r *Compiler) CompileString(data string) (*Template, error) {
-	tmpl := Template{data, "{{", "}}", 0, 1, []interface{}{}, false, r.partial, r.outputMode, r.errorOnMissing, r}
+	if r.cache != nil {
+		return r.cache.get(data, func(data string) (*Template, error) {
+			return r.compileNamed("", data)
+		})
+	}
+	return r.compileNamed("", data)
+}
+
+// compileNamed compiles a template with the given name, which relative partial names in it are resolved against,
+// without using the parse cache, as the template returned may be changed.
+func (r *Compiler) compileNamed(name, data string) (*Template, error) {
+	if r.limits.MaxBytes > 0 && len(data) > r.limits.MaxBytes {
+		return nil, fmt.Errorf("template is %d bytes, more than the limit of %d", len(data), r.limits.MaxBytes)
+	}
+	if r.validateUTF8 {
+		if err := validateUTF8(data); err != nil {
+			return nil, err
+		}
+	}
+	if !r.preserveBOM {
+		data = strings.TrimPrefix(data, "\uFEFF")
+	}
+	// the template keeps a copy of the compiler's options, without its cache, to compile its partials with, so that
+	// setting options on the compiler later doesn't change the templates already compiled
+	options := *r
+	options.cache = nil
+	tmpl := Template{
+		name:           name,
+		data:           data,
+		otag:           "{{",
+		ctag:           "}}",
+		p:              0,
+		curline:        1,
+		elems:          []interface{}{},
+		forceRaw:       false,
+		partial:        r.partial,
+		outputMode:     r.outputMode,
+		errorOnMissing: r.errorOnMissing,
+		missingPartial: r.missingPartial,
+		logger:         r.logger,
+		escapeFunc:     r.escapeFunc,
+		tagEscapeFunc:  r.tagEscapeFunc,
+		maxOutput:      r.maxOutput,
+		trimValues:     r.trimValues,
+		wsTruthy:       r.wsTruthy,
+		layoutSlot:     r.layoutSlot,
+		passthrough:    r.passthrough,
+		zeroTruthy:     r.zeroTruthy,
+		sanitizer:      r.sanitizer,
+		truthyFunc:     r.truthyFunc,
+		pluralRule:     r.pluralRule,
+		disallowRaw:    r.disallowRaw,
+		boolStrings:    r.boolStrings,
+		strictTypes:    r.strictTypes,
+		htmlEscaper:    r.htmlEscaper,
+		blockHelpers:   r.blockHelpers,
+		stdHelpers:     r.stdHelpers,
+		funcs:          r.funcs,
+		numThreshold:   r.numThreshold,
+		limits:         r.limits,
+		maxIterations:  r.maxIterations,
+		sectionFilters: r.sectionFilters,
+		namespaces:     r.namespaces,
+		typeStringers:  r.typeStringers,
+		trimComments:   r.trimComments,
+		beforePartial:  r.beforePartial,
+		afterPartial:   r.afterPartial,
+		preprocessor:   r.preprocessor,
+		indentTabWidth: r.indentTabWidth,
+		resolver:       r.resolver,
+		collectMissing: r.collectMissing,
+		mapMode:        r.mapMode,
+		maxContext:     r.maxContext,
+		strictInvert:   r.strictInvert,
+		parent:         &options,
+	}
 	err := tmpl.parse()
 	if err != nil {
 		return nil, err
 	}
+	if r.lineEndings != Preserve {
+		normalizeLineEndings(tmpl.elems, r.lineEndings)
+		for _, elems := range tmpl.defines {
+			normalizeLineEndings(elems, r.lineEndings)
+		}
+	}
 	return &tmpl, nil
 }
 
+// validateUTF8 returns an error giving the position of the first invalid UTF-8 sequence in a template's source.
+func validateUTF8(data string) error {
+	for i, r := range data {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(data[i:]); size == 1 {
+				line := strings.Count(data[:i], "\n") + 1
+				return parseError{line, fmt.Sprintf("invalid UTF-8 at byte offset %d", i)}
+			}
+		}
+	}
+	return nil
+}
+
 // CompileFile compiles a Mustache template from a file.
 func (r *Compiler) CompileFile(filename string) (*Template, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return r.CompileString(string(data))
+	return r.compileFile(filename, filepath.Ext(filename), string(data))
+}
+
+// CompileFS compiles a Mustache template from a file in the given filesystem.
+func (r *Compiler) CompileFS(fsys fs.FS, name string) (*Template, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return r.compileFile(name, path.Ext(name), string(data))
+}
+
+// compileFile compiles a template read from the named file with the given extension.
+func (r *Compiler) compileFile(name, ext, data string) (*Template, error) {
+	if r.trimNewline {
+		if strings.HasSuffix(data, "\r\n") {
+			data = data[:len(data)-2]
+		} else {
+			data = strings.TrimSuffix(data, "\n")
+		}
+	}
+	tmpl, err := r.compileNamed(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := r.extModes[ext]; ok {
+		tmpl.outputMode = m
+	}
+	return tmpl, nil
 }
 
 // A TagType represents the specific type of mustache tag that a Tag
@@ -76,6 +736,7 @@ const (
 	Section
 	InvertedSection
 	Partial
+	SetDelimiter
 )
 
 // Skip all whitespaces apeared after these types of tags until end of line
@@ -97,6 +758,7 @@ var tagNames = []string{
 	Section:         "Section",
 	InvertedSection: "InvertedSection",
 	Partial:         "Partial",
+	SetDelimiter:    "SetDelimiter",
 }
 
 // Tag represents the different mustache tag types.
@@ -120,47 +782,191 @@ type textElement struct {
 }
 
 type varElement struct {
-	name string
-	raw  bool
+	name   string
+	helper string
+	args   []tagArg
+	fn     reflect.Value // The function registered with WithFuncs which the tag calls, if any
+	raw    bool
+	src    string // The tag as it appears in the template
+	line   int
 }
 
 type sectionElement struct {
 	name      string
+	helper    string
 	inverted  bool
 	startline int
 	elems     []interface{}
+	inverse   []interface{} // The part of the section after its {{else}} tag, rendered when the body is not
+	args      []tagArg      // The arguments of a registered block helper, which are not nil even if there are none
+	src       string        // The whole section as it appears in the template, including its tags
+	alias     string        // The name the value or each element is bound to in the body, as in {{#users as user}}
+	elseVar   *varElement   // The {{else}} tag of a plain section, rendered as a variable if the data has an else value
+}
+
+// Names of the built-in block helpers, which are written as {{#helper name}}...{{/helper}}.
+const (
+	withHelper   = "with"   // Push the value on to the context once, without iterating over it
+	eachHelper   = "each"   // Always iterate over the elements of the value, binding @index, @key and @value
+	fieldsHelper = "fields" // Iterate over the exported fields of a struct, binding @index, @key and @value
+	defineHelper = "define" // Define a named template, which is not rendered in place but by RenderNamed
+	ifHelper     = "if"     // Render the body if the value is truthy and the {{else}} part if not, with WithStandardHelpers
+	unlessHelper = "unless" // Render the body if the value is falsy and the {{else}} part if not, with WithStandardHelpers
+)
+
+// Names of the built-in variable helpers, which are written as {{helper name}}.
+const (
+	safeHelper    = "safe"    // Pass the value through the sanitizer, and write it without escaping
+	pluralHelper  = "plural"  // Choose between the forms given as arguments by the number the value holds
+	ordinalHelper = "ordinal" // Write the number the value holds as an English ordinal, such as 1st or 22nd
+	jsonHelper    = "json"    // Write the value as indented JSON, without escaping, whatever the output mode
+)
+
+// takesElse reports whether the section may contain an {{else}} tag, which any section may except an inverted one or
+// a define block.
+func (e *sectionElement) takesElse() bool {
+	return !e.inverted && e.helper != defineHelper
+}
+
+// closingName returns the name which must appear in the tag closing the section.
+func (e *sectionElement) closingName() string {
+	if e.helper != "" {
+		return e.helper
+	}
+	return e.name
+}
+
+type delimElement struct {
+	otag string
+	ctag string
 }
 
+// selfPartial is the name by which a template, or a partial, includes itself, as in {{#children}}{{>@self}}{{/children}}.
+const selfPartial = "@self"
+
 type partialElement struct {
-	name   string
-	indent string
-	prov   PartialProvider
+	name     string
+	context  string // The name of the value to render the partial with, in place of the current context
+	optional bool   // Whether to render nothing, without an error, if the partial doesn't exist
+	raw      bool   // Whether to write the source of the partial as it is, without compiling it
+	line     int
+	indent   string
+	prov     PartialProvider
 }
 
 // EscapeMode indicates what sort of escaping to perform in template output.
 // EscapeHTML is the default, and assumes the template is producing HTML.
 // EscapeJSON switches to JSON escaping, for use cases such as generating Slack messages.
 // Raw turns off escaping, for situations where you are absolutely sure you want plain text.
+// EscapeHTMLAttr is for templates whose values go in HTML attributes, and always escapes both quotes, so a value can't
+// end a single- or double-quoted attribute early, even if WithHTMLEscapeChars limits the escaping of EscapeHTML.
 type EscapeMode int
 
 const (
-	EscapeHTML EscapeMode = iota // Escape output as HTML (default)
-	EscapeJSON                   // Escape output as JSON
-	Raw                          // Do not escape output (plain text mode)
+	EscapeHTML     EscapeMode = iota // Escape output as HTML (default)
+	EscapeJSON                       // Escape output as JSON
+	Raw                              // Do not escape output (plain text mode)
+	EscapeHTMLAttr                   // Escape output as HTML attribute values, escaping &<>"'
+)
+
+// MapSectionMode determines how a section whose value is a map is rendered; see Compiler.WithMapSectionMode.
+type MapSectionMode int
+
+const (
+	AsContext MapSectionMode = iota // Render the section once with the map as the context (default)
+	AsPairs                         // Render the section once for each key and value of the map
+)
+
+// htmlAttrEscaper escapes values in EscapeHTMLAttr mode.
+var htmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;", "'", "&#39;")
+
+// SafeString is a string of HTML which is known to be safe, such as the output of a sanitizer. In HTML mode, a value
+// of this type, or of html/template's HTML type, is written without escaping even by a {{name}} tag, so the code
+// producing data can mark individual values as safe. Other escape modes escape it as usual.
+type SafeString string
+
+var (
+	safeStringType   = reflect.TypeOf(SafeString(""))
+	templateHTMLType = reflect.TypeOf(template.HTML(""))
+)
+
+// isSafeHTML reports whether a value is a SafeString or a template.HTML, which are written without escaping in HTML
+// mode.
+func isSafeHTML(v reflect.Value) bool {
+	v = indirect(v)
+	return v.IsValid() && (v.Type() == safeStringType || v.Type() == templateHTMLType)
+}
+
+// EscapeFunc writes a value to the output, escaping it as required. JSONEscape is an example of an EscapeFunc.
+type EscapeFunc func(w io.Writer, s string) error
+
+// TagEscapeFunc writes the value of the named tag to the output, escaping it as required. Raw is true if the value is
+// from a {{{name}}} or {{&name}} tag.
+type TagEscapeFunc func(w io.Writer, name string, raw bool, s string) error
+
+// LineEndingMode indicates how line endings in the literal text of a template are written to the output.
+type LineEndingMode int
+
+const (
+	Preserve LineEndingMode = iota // Write line endings as they appear in the template (default)
+	LF                             // Convert line endings to "\n"
+	CRLF                           // Convert line endings to "\r\n"
 )
 
 // Template represents a compiled mustache template which can be used to render data.
 type Template struct {
+	name           string
 	data           string
 	otag           string
 	ctag           string
 	p              int
 	curline        int
 	elems          []interface{}
+	defines        map[string][]interface{}
 	forceRaw       bool
 	partial        PartialProvider
 	outputMode     EscapeMode
 	errorOnMissing bool
+	missingPartial func(name string) string
+	logger         Logger
+	escapeFunc     EscapeFunc
+	tagEscapeFunc  TagEscapeFunc
+	maxOutput      int64
+	trimValues     bool
+	wsTruthy       bool
+	layoutSlot     string
+	passthrough    bool
+	zeroTruthy     bool
+	sanitizer      func(string) string
+	truthyFunc     func(value interface{}) bool
+	pluralRule     PluralRule
+	disallowRaw    bool
+	boolStrings    []string
+	strictTypes    bool
+	htmlEscaper    *strings.Replacer
+	blockHelpers   map[string]BlockHelperFn
+	stdHelpers     bool
+	funcs          map[string]reflect.Value
+	numThreshold   *float64
+	limits         CompileLimits
+	maxIterations  int
+	sectionFilters map[string]func(interface{}) bool
+	namespaces     map[string]interface{}
+	typeStringers  map[reflect.Type]TypeStringer
+	trimComments   bool
+	beforePartial  func(string) error
+	afterPartial   func(string) error
+	preprocessor   func(name, source string) (string, error)
+	indentTabWidth int
+	resolver       func(interface{}, string) (interface{}, bool)
+	collectMissing bool
+	mapMode        MapSectionMode
+	maxContext     int
+	strictInvert   bool
+	unindented     string // The source of a partial before it was indented, which {{>@self}} includes
+	elseAllowed    bool   // Whether an {{else}} tag is expected in the section being parsed
+	tags           int    // The number of tags parsed so far
+	depth          int    // The depth of nested sections being parsed
 	parent         *Compiler
 }
 
@@ -174,6 +980,108 @@ func (tmpl *Template) Tags() []Tag {
 	return extractTags(tmpl.elems)
 }
 
+// MaxDepth returns the depth of the most deeply nested section in the template and its define blocks: 0 if it has no
+// sections, 1 if none is inside another, and so on. Sections in the {{else}} part of a section count as inside it, and
+// partials are not fetched.
+func (tmpl *Template) MaxDepth() int {
+	depth := maxDepth(tmpl.elems)
+	for _, elems := range tmpl.defines {
+		depth = maxInt(depth, maxDepth(elems))
+	}
+	return depth
+}
+
+// maxDepth returns the depth of the most deeply nested section among the elements.
+func maxDepth(elems []interface{}) int {
+	depth := 0
+	for _, elem := range elems {
+		if se, ok := elem.(*sectionElement); ok {
+			depth = maxInt(depth, maxInt(1+maxDepth(se.elems), 1+maxDepth(se.inverse)))
+		}
+	}
+	return depth
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// SetEscapeMode returns a copy of the template which escapes its output, and that of its partials, with the given
+// mode, so one compiled template can be rendered for several formats. The copy shares the parsed template, and the
+// original is unchanged, so it is safe to call while the template is being rendered.
+func (tmpl *Template) SetEscapeMode(m EscapeMode) *Template {
+	clone := *tmpl
+	clone.outputMode = m
+	return &clone
+}
+
+// UnpairedSections returns the sorted names of the sections in the template, including those of its define blocks, which
+// have no inverted section of the same name and no {{else}} part, and of the inverted sections which have no section of
+// the same name, so that linters can flag lists without an empty state. Pairs are matched anywhere in the same
+// template or define block. Sections using the each, with and fields helpers are named as written, such as
+// "each items"; other block helpers are ignored.
+func (tmpl *Template) UnpairedSections() []string {
+	found := map[string]bool{}
+	unpairedSections(tmpl.elems, found)
+	for _, elems := range tmpl.defines {
+		unpairedSections(elems, found)
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unpairedSections adds the names of the unpaired sections among the elements, and their children, to found.
+func unpairedSections(elems []interface{}, found map[string]bool) {
+	sections := map[string]bool{}
+	inverted := map[string]bool{}
+	paired := map[string]bool{} // sections with an {{else}} part
+	var visit func(elems []interface{})
+	visit = func(elems []interface{}) {
+		for _, elem := range elems {
+			se, ok := elem.(*sectionElement)
+			if !ok {
+				continue
+			}
+			visit(se.elems)
+			visit(se.inverse)
+			name := se.name
+			switch se.helper {
+			case "":
+			case withHelper, eachHelper, fieldsHelper:
+				name = se.helper + " " + se.name
+			default:
+				continue
+			}
+			switch {
+			case se.inverted:
+				inverted[name] = true
+			case se.inverse != nil:
+				paired[name] = true
+			default:
+				sections[name] = true
+			}
+		}
+	}
+	visit(elems)
+	for name := range sections {
+		if !inverted[name] && !paired[name] {
+			found[name] = true
+		}
+	}
+	for name := range inverted {
+		if !sections[name] && !paired[name] {
+			found[name] = true
+		}
+	}
+}
+
 func extractTags(elems []interface{}) []Tag {
 	tags := make([]Tag, 0, len(elems))
 	for _, elem := range elems {
@@ -184,6 +1092,8 @@ func extractTags(elems []interface{}) []Tag {
 			tags = append(tags, elem)
 		case *partialElement:
 			tags = append(tags, elem)
+		case *delimElement:
+			tags = append(tags, elem)
 		}
 	}
 	return tags
@@ -213,7 +1123,7 @@ func (e *sectionElement) Name() string {
 }
 
 func (e *sectionElement) Tags() []Tag {
-	return extractTags(e.elems)
+	return append(extractTags(e.elems), extractTags(e.inverse)...)
 }
 
 func (e *partialElement) Type() TagType {
@@ -228,11 +1138,24 @@ func (e *partialElement) Tags() []Tag {
 	return nil
 }
 
-func (p parseError) Error() string {
-	return fmt.Sprintf("line %d: %s", p.line, p.message)
+func (e *delimElement) Type() TagType {
+	return SetDelimiter
 }
 
-func (tmpl *Template) readString(s string) (string, error) {
+// Name returns the new delimiters, separated by a space.
+func (e *delimElement) Name() string {
+	return e.otag + " " + e.ctag
+}
+
+func (e *delimElement) Tags() []Tag {
+	panic("mustache: Tags on SetDelimiter type")
+}
+
+func (p parseError) Error() string {
+	return fmt.Sprintf("line %d: %s", p.line, p.message)
+}
+
+func (tmpl *Template) readString(s string) (string, error) {
 	newlines := 0
 	for i := tmpl.p; ; i++ {
 		// are we at the end of the string?
@@ -314,6 +1237,10 @@ type tagReadingResult struct {
 }
 
 func (tmpl *Template) readTag(mayStandalone bool) (*tagReadingResult, error) {
+	tmpl.tags++
+	if tmpl.limits.MaxTags > 0 && tmpl.tags > tmpl.limits.MaxTags {
+		return nil, parseError{tmpl.curline, fmt.Sprintf("more than the limit of %d tags", tmpl.limits.MaxTags)}
+	}
 	var text string
 	var err error
 	if tmpl.p < len(tmpl.data) && tmpl.data[tmpl.p] == '{' {
@@ -345,7 +1272,7 @@ func (tmpl *Template) readTag(mayStandalone bool) (*tagReadingResult, error) {
 
 	standalone := true
 	if mayStandalone {
-		if !strings.Contains(SkipWhitespaceTagTypes, tag[0:1]) {
+		if !strings.Contains(SkipWhitespaceTagTypes, tag[0:1]) && !(tag == "else" && tmpl.elseAllowed) {
 			standalone = false
 		} else {
 			if eow == len(tmpl.data) {
@@ -371,15 +1298,302 @@ func (tmpl *Template) readTag(mayStandalone bool) (*tagReadingResult, error) {
 	}, nil
 }
 
-func (tmpl *Template) parsePartial(name, indent string) (*partialElement, error) {
-	return &partialElement{
-		name:   name,
+// skipCommentLine skips the rest of the line after a comment at its start, if it holds only more comments and
+// whitespace, and reports whether it did.
+func (tmpl *Template) skipCommentLine() bool {
+	p, lines := tmpl.p, 0
+	for {
+		for p < len(tmpl.data) && (tmpl.data[p] == ' ' || tmpl.data[p] == '\t') {
+			p++
+		}
+		if !strings.HasPrefix(tmpl.data[p:], tmpl.otag+"!") {
+			break
+		}
+		end := strings.Index(tmpl.data[p+len(tmpl.otag):], tmpl.ctag)
+		if end < 0 {
+			return false
+		}
+		end += p + len(tmpl.otag) + len(tmpl.ctag)
+		lines += strings.Count(tmpl.data[p:end], "\n")
+		p = end
+	}
+	switch {
+	case p == len(tmpl.data):
+	case tmpl.data[p] == '\n':
+		p, lines = p+1, lines+1
+	case strings.HasPrefix(tmpl.data[p:], "\r\n"):
+		p, lines = p+2, lines+1
+	default:
+		return false
+	}
+	tmpl.p, tmpl.curline = p, tmpl.curline+lines
+	return true
+}
+
+func normalizeLineEndings(elems []interface{}, m LineEndingMode) {
+	for _, elem := range elems {
+		switch elem := elem.(type) {
+		case *textElement:
+			text := bytes.ReplaceAll(elem.text, []byte("\r\n"), []byte("\n"))
+			if m == CRLF {
+				text = bytes.ReplaceAll(text, []byte("\n"), []byte("\r\n"))
+			}
+			elem.text = text
+		case *sectionElement:
+			normalizeLineEndings(elem.elems, m)
+			normalizeLineEndings(elem.inverse, m)
+		}
+	}
+}
+
+func (tmpl *Template) parsePartial(name, indent string, line int) (*partialElement, error) {
+	pe := &partialElement{
 		indent: indent,
 		prov:   tmpl.partial,
-	}, nil
+		line:   line,
+	}
+	if strings.HasPrefix(name, "?") {
+		pe.optional = true
+		name = strings.TrimSpace(name[1:])
+	}
+	if strings.HasPrefix(name, "&") {
+		pe.raw = true
+		name = strings.TrimSpace(name[1:])
+	}
+	pe.name = name
+	if pe.raw && name == selfPartial {
+		return nil, parseError{tmpl.curline, "raw partial cannot include " + selfPartial}
+	}
+	// A partial whose name has a space in it is still included with the current context, as it was before a context
+	// could be named, so long as the partial provider has it.
+	if words := strings.Fields(name); len(words) == 2 && !tmpl.hasPartial(name) {
+		if pe.raw {
+			return nil, parseError{tmpl.curline, "raw partial " + words[0] + " cannot have a context"}
+		}
+		pe.name, pe.context = words[0], words[1]
+	}
+	return pe, nil
+}
+
+// newVar returns a new variable element for the given tag, recognizing any built-in variable helper.
+func (tmpl *Template) newVar(name string, raw bool, src string, line int) (*varElement, error) {
+	ve := &varElement{name: name, raw: raw, src: src, line: line}
+	words := strings.Fields(name)
+	if len(words) == 0 {
+		return ve, nil
+	}
+	switch words[0] {
+	case safeHelper, pluralHelper, ordinalHelper, jsonHelper:
+		if len(words) < 2 {
+			return ve, nil
+		}
+	default:
+		if fn, ok := tmpl.funcs[words[0]]; ok {
+			args, err := splitArgs(strings.TrimSpace(name[len(words[0]):]))
+			if err != nil {
+				return nil, parseError{tmpl.curline, err.Error()}
+			}
+			ve.helper, ve.fn, ve.args = words[0], fn, args
+		}
+		return ve, nil
+	}
+	args, err := splitArgs(strings.TrimSpace(name[len(words[0]):]))
+	if err != nil {
+		return nil, parseError{tmpl.curline, err.Error()}
+	}
+	if args[0].literal {
+		return nil, parseError{tmpl.curline, words[0] + " needs a variable name, not a string"}
+	}
+	ve.helper, ve.name, ve.args = words[0], args[0].text, args[1:]
+	switch {
+	case ve.helper == pluralHelper && len(ve.args) == 0:
+		return nil, parseError{tmpl.curline, "plural needs at least one form"}
+	case ve.helper != pluralHelper && len(ve.args) != 0:
+		return nil, parseError{tmpl.curline, "too many arguments to " + ve.helper}
+	}
+	return ve, nil
+}
+
+// A tagArg is an argument to a helper, which is either a name to look up in the context or a literal string.
+type tagArg struct {
+	text    string
+	literal bool
+}
+
+// String returns the argument as it would be written in a tag.
+func (a tagArg) String() string {
+	if a.literal {
+		return strconv.Quote(a.text)
+	}
+	return a.text
+}
+
+// splitArgs splits the arguments of a helper, which are separated by whitespace. An argument is either a name or a
+// Go string literal in double quotes or backquotes, which may contain whitespace.
+func splitArgs(s string) ([]tagArg, error) {
+	var args []tagArg
+	for s = strings.TrimLeftFunc(s, unicode.IsSpace); s != ""; s = strings.TrimLeftFunc(s, unicode.IsSpace) {
+		if s[0] != '"' && s[0] != '`' {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+			if strings.ContainsAny(s[:end], "\"`") {
+				return nil, fmt.Errorf("invalid argument %s", s[:end])
+			}
+			args = append(args, tagArg{text: s[:end]})
+			s = s[end:]
+			continue
+		}
+		quoted, err := quotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		text, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", quoted)
+		}
+		args = append(args, tagArg{text: text, literal: true})
+		s = s[len(quoted):]
+		if s != "" && strings.TrimLeftFunc(s, unicode.IsSpace) == s {
+			return nil, fmt.Errorf("missing space after %s", quoted)
+		}
+	}
+	return args, nil
+}
+
+// quotedPrefix returns the double or back quoted string at the start of s, with its quotes.
+func quotedPrefix(s string) (string, error) {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == s[0]:
+			return s[:i+1], nil
+		case s[0] == '"' && s[i] == '\\':
+			i++
+		case s[0] == '"' && s[i] == '\n':
+			return "", strconv.ErrSyntax
+		}
+	}
+	return "", strconv.ErrSyntax
+}
+
+// newSection returns a new section element for the given section tag, recognizing any built-in or registered block
+// helper.
+func (tmpl *Template) newSection(tag string, line int) (*sectionElement, error) {
+	se := &sectionElement{
+		name:      strings.TrimSpace(tag[1:]),
+		inverted:  tag[0] == '^',
+		startline: line,
+		elems:     []interface{}{},
+	}
+	words := strings.Fields(se.name)
+	if n := len(words); n >= 3 && words[n-2] == "as" {
+		alias := words[n-1]
+		words = words[:n-2]
+		if se.inverted || !isIdentifier(alias) || len(words) > 2 ||
+			len(words) == 2 && words[0] != withHelper && words[0] != eachHelper && words[0] != fieldsHelper {
+			return nil, parseError{tmpl.curline, "as can only name the value of a section or a with, each or fields block: " + tag}
+		}
+		se.name, se.alias = strings.Join(words, " "), alias
+	}
+	if len(words) == 2 {
+		switch words[0] {
+		case withHelper, eachHelper, fieldsHelper:
+			se.helper, se.name = words[0], words[1]
+			return se, nil
+		case ifHelper, unlessHelper:
+			if tmpl.stdHelpers && !se.inverted {
+				se.helper, se.name = words[0], words[1]
+				return se, nil
+			}
+		}
+	}
+	if len(words) > 0 && !se.inverted && !isBuiltinBlock(words[0]) {
+		if _, ok := tmpl.blockHelpers[words[0]]; ok {
+			rest := strings.TrimSpace(se.name[len(words[0]):])
+			args, err := splitArgs(rest)
+			if err != nil {
+				return nil, parseError{tmpl.curline, err.Error()}
+			}
+			if args == nil {
+				args = []tagArg{}
+			}
+			se.helper, se.name, se.args = words[0], rest, args
+			return se, nil
+		}
+	}
+	if rest := strings.TrimPrefix(se.name, defineHelper+" "); rest != se.name && !se.inverted {
+		se.helper, se.name = defineHelper, strings.TrimSpace(rest)
+		if name, err := strconv.Unquote(se.name); err == nil {
+			se.name = name
+		}
+	}
+	return se, nil
+}
+
+// isIdentifier reports whether name can be bound by an as clause: letters, digits and underscores, not starting with a
+// digit.
+func isIdentifier(name string) bool {
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// isBuiltinBlock reports whether name is the name of one of the built-in block helpers, which take precedence over
+// those registered with WithBlockHelpers.
+func isBuiltinBlock(name string) bool {
+	switch name {
+	case withHelper, eachHelper, fieldsHelper, defineHelper:
+		return true
+	}
+	return false
+}
+
+// define registers the contents of a define section as a named template.
+func (tmpl *Template) define(se *sectionElement) error {
+	if _, ok := tmpl.defines[se.name]; ok {
+		return parseError{se.startline, "template " + se.name + " is already defined"}
+	}
+	if tmpl.defines == nil {
+		tmpl.defines = map[string][]interface{}{}
+	}
+	tmpl.defines[se.name] = se.elems
+	return nil
+}
+
+// setDelimiters handles a set delimiter tag such as {{=<% %>=}}, which must give exactly two delimiters, neither
+// of which may contain whitespace or '='. Delimiters may overlap; a tag always ends at the first closing delimiter
+// after the opening one.
+func (tmpl *Template) setDelimiters(tag string) (*delimElement, error) {
+	if len(tag) < 2 || tag[len(tag)-1] != '=' {
+		return nil, parseError{tmpl.curline, "invalid set delimiter"}
+	}
+	newtags := strings.Fields(tag[1 : len(tag)-1])
+	if len(newtags) != 2 || strings.Contains(newtags[0], "=") || strings.Contains(newtags[1], "=") {
+		return nil, parseError{tmpl.curline, "invalid set delimiter"}
+	}
+	tmpl.otag = newtags[0]
+	tmpl.ctag = newtags[1]
+	if tmpl.logger != nil {
+		tmpl.logger.Debug("mustache: delimiters changed", "line", tmpl.curline, "open", tmpl.otag, "close", tmpl.ctag)
+	}
+	return &delimElement{tmpl.otag, tmpl.ctag}, nil
 }
 
 func (tmpl *Template) parseSection(section *sectionElement) error {
+	tmpl.depth++
+	defer func() { tmpl.depth-- }()
+	if tmpl.limits.MaxDepth > 0 && tmpl.depth > tmpl.limits.MaxDepth {
+		return parseError{section.startline, fmt.Sprintf("sections nested more than the limit of %d deep",
+			tmpl.limits.MaxDepth)}
+	}
+	elseAllowed := tmpl.elseAllowed
+	tmpl.elseAllowed = section.takesElse()
+	defer func() { tmpl.elseAllowed = elseAllowed }()
+	elseAt := -1
 	for {
 		textResult, err := tmpl.readText()
 		text := textResult.text
@@ -394,12 +1608,17 @@ func (tmpl *Template) parseSection(section *sectionElement) error {
 		// put text into an item
 		section.elems = append(section.elems, &textElement{[]byte(text)})
 
+		start, line := tmpl.p-len(tmpl.otag), tmpl.curline
 		tagResult, err := tmpl.readTag(mayStandalone)
 		if err != nil {
 			return err
 		}
 
-		if !tagResult.standalone {
+		standalone := tagResult.standalone
+		if !standalone && mayStandalone && tmpl.trimComments && tagResult.tag[0] == '!' {
+			standalone = tmpl.skipCommentLine()
+		}
+		if !standalone {
 			section.elems = append(section.elems, &textElement{[]byte(padding)})
 		}
 
@@ -409,47 +1628,89 @@ func (tmpl *Template) parseSection(section *sectionElement) error {
 			// ignore comment
 			break
 		case '#', '^':
-			name := strings.TrimSpace(tag[1:])
-			se := sectionElement{name, tag[0] == '^', tmpl.curline, []interface{}{}}
-			err := tmpl.parseSection(&se)
+			se, err := tmpl.newSection(tag, line)
 			if err != nil {
 				return err
 			}
-			section.elems = append(section.elems, &se)
+			if err := tmpl.parseSection(se); err != nil {
+				return err
+			}
+			se.src = tmpl.data[start:tmpl.p]
+			if se.helper == defineHelper {
+				if err := tmpl.define(se); err != nil {
+					return err
+				}
+				break
+			}
+			section.elems = append(section.elems, se)
 		case '/':
 			name := strings.TrimSpace(tag[1:])
-			if name != section.name {
+			if name != section.closingName() {
 				return parseError{tmpl.curline, "interleaved closing tag: " + name}
 			}
+			if elseAt >= 0 {
+				section.inverse = section.elems[elseAt:]
+				section.elems = section.elems[:elseAt]
+			}
 			return nil
 		case '>':
 			name := strings.TrimSpace(tag[1:])
-			partial, err := tmpl.parsePartial(name, textResult.padding)
+			partial, err := tmpl.parsePartial(name, textResult.padding, line)
 			if err != nil {
 				return err
 			}
 			section.elems = append(section.elems, partial)
 		case '=':
-			if len(tag) < 2 || tag[len(tag)-1] != '=' {
-				return parseError{tmpl.curline, "invalid meta tag"}
+			de, err := tmpl.setDelimiters(tag)
+			if err != nil {
+				return err
 			}
-			tag = strings.TrimSpace(tag[1 : len(tag)-1])
-			newtags := strings.SplitN(tag, " ", 2)
-			if len(newtags) == 2 {
-				tmpl.otag = newtags[0]
-				tmpl.ctag = newtags[1]
+			if de != nil {
+				section.elems = append(section.elems, de)
 			}
 		case '{':
+			if tmpl.disallowRaw {
+				return parseError{tmpl.curline, "raw tag not allowed: " + tmpl.data[start:tmpl.p]}
+			}
 			if tag[len(tag)-1] == '}' {
 				// use a raw tag
 				name := strings.TrimSpace(tag[1 : len(tag)-1])
-				section.elems = append(section.elems, &varElement{name, true})
+				ve, err := tmpl.newVar(name, true, tmpl.data[start:tmpl.p], line)
+				if err != nil {
+					return err
+				}
+				section.elems = append(section.elems, ve)
 			}
 		case '&':
+			if tmpl.disallowRaw {
+				return parseError{tmpl.curline, "raw tag not allowed: " + tmpl.data[start:tmpl.p]}
+			}
 			name := strings.TrimSpace(tag[1:])
-			section.elems = append(section.elems, &varElement{name, true})
+			ve, err := tmpl.newVar(name, true, tmpl.data[start:tmpl.p], line)
+			if err != nil {
+				return err
+			}
+			section.elems = append(section.elems, ve)
 		default:
-			section.elems = append(section.elems, &varElement{tag, tmpl.forceRaw})
+			if tag == "else" && section.takesElse() {
+				if elseAt >= 0 {
+					return parseError{tmpl.curline, "more than one else in " + section.closingName()}
+				}
+				elseAt = len(section.elems)
+				if section.helper == "" {
+					ve, err := tmpl.newVar(tag, tmpl.forceRaw, tmpl.data[start:tmpl.p], line)
+					if err != nil {
+						return err
+					}
+					section.elseVar = ve
+				}
+				break
+			}
+			ve, err := tmpl.newVar(tag, tmpl.forceRaw, tmpl.data[start:tmpl.p], line)
+			if err != nil {
+				return err
+			}
+			section.elems = append(section.elems, ve)
 		}
 	}
 }
@@ -470,12 +1731,17 @@ func (tmpl *Template) parse() error {
 		// put text into an item
 		tmpl.elems = append(tmpl.elems, &textElement{[]byte(text)})
 
+		start, line := tmpl.p-len(tmpl.otag), tmpl.curline
 		tagResult, err := tmpl.readTag(mayStandalone)
 		if err != nil {
 			return err
 		}
 
-		if !tagResult.standalone {
+		standalone := tagResult.standalone
+		if !standalone && mayStandalone && tmpl.trimComments && tagResult.tag[0] == '!' {
+			standalone = tmpl.skipCommentLine()
+		}
+		if !standalone {
 			tmpl.elems = append(tmpl.elems, &textElement{[]byte(padding)})
 		}
 
@@ -485,59 +1751,107 @@ func (tmpl *Template) parse() error {
 			// ignore comment
 			break
 		case '#', '^':
-			name := strings.TrimSpace(tag[1:])
-			se := sectionElement{name, tag[0] == '^', tmpl.curline, []interface{}{}}
-			err := tmpl.parseSection(&se)
+			se, err := tmpl.newSection(tag, line)
 			if err != nil {
 				return err
 			}
-			tmpl.elems = append(tmpl.elems, &se)
+			if err := tmpl.parseSection(se); err != nil {
+				return err
+			}
+			se.src = tmpl.data[start:tmpl.p]
+			if se.helper == defineHelper {
+				if err := tmpl.define(se); err != nil {
+					return err
+				}
+				break
+			}
+			tmpl.elems = append(tmpl.elems, se)
 		case '/':
 			return parseError{tmpl.curline, "unmatched close tag"}
 		case '>':
 			name := strings.TrimSpace(tag[1:])
-			partial, err := tmpl.parsePartial(name, textResult.padding)
+			partial, err := tmpl.parsePartial(name, textResult.padding, line)
 			if err != nil {
 				return err
 			}
 			tmpl.elems = append(tmpl.elems, partial)
 		case '=':
-			if tag[len(tag)-1] != '=' || len(tag) < 2 {
-				return parseError{tmpl.curline, "Invalid meta tag"}
+			de, err := tmpl.setDelimiters(tag)
+			if err != nil {
+				return err
 			}
-			tag = strings.TrimSpace(tag[1 : len(tag)-1])
-			newtags := strings.SplitN(tag, " ", 2)
-			if len(newtags) == 2 {
-				tmpl.otag = newtags[0]
-				tmpl.ctag = newtags[1]
+			if de != nil {
+				tmpl.elems = append(tmpl.elems, de)
 			}
 		case '{':
+			if tmpl.disallowRaw {
+				return parseError{tmpl.curline, "raw tag not allowed: " + tmpl.data[start:tmpl.p]}
+			}
 			// use a raw tag
 			if tag[len(tag)-1] == '}' {
 				name := strings.TrimSpace(tag[1 : len(tag)-1])
-				tmpl.elems = append(tmpl.elems, &varElement{name, true})
+				ve, err := tmpl.newVar(name, true, tmpl.data[start:tmpl.p], line)
+				if err != nil {
+					return err
+				}
+				tmpl.elems = append(tmpl.elems, ve)
 			}
 		case '&':
+			if tmpl.disallowRaw {
+				return parseError{tmpl.curline, "raw tag not allowed: " + tmpl.data[start:tmpl.p]}
+			}
 			name := strings.TrimSpace(tag[1:])
-			tmpl.elems = append(tmpl.elems, &varElement{name, true})
+			ve, err := tmpl.newVar(name, true, tmpl.data[start:tmpl.p], line)
+			if err != nil {
+				return err
+			}
+			tmpl.elems = append(tmpl.elems, ve)
 		default:
-			tmpl.elems = append(tmpl.elems, &varElement{tag, tmpl.forceRaw})
+			ve, err := tmpl.newVar(tag, tmpl.forceRaw, tmpl.data[start:tmpl.p], line)
+			if err != nil {
+				return err
+			}
+			tmpl.elems = append(tmpl.elems, ve)
+		}
+	}
+}
+
+// lookup looks up a name in the context, or if it is in one of the namespaces set with WithContextNamespace, in the
+// data for the namespace.
+func (tmpl *Template) lookup(contextChain []interface{}, name string) (reflect.Value, error) {
+	return tmpl.lookupName(contextChain, name, tmpl.errorOnMissing)
+}
+
+// lookupName is like lookup, but whether a missing name is an error is given.
+func (tmpl *Template) lookupName(contextChain []interface{}, name string, errorOnMissing bool) (reflect.Value, error) {
+	if strings.HasPrefix(name, "@") && tmpl.namespaces != nil {
+		parts := strings.SplitN(name[1:], ".", 2)
+		if data, ok := tmpl.namespaces[parts[0]]; ok {
+			if len(parts) == 1 {
+				return reflect.ValueOf(data), nil
+			}
+			return lookup([]interface{}{reflect.ValueOf(data)}, parts[1], errorOnMissing, tmpl.resolver)
 		}
 	}
+	return lookup(contextChain, name, errorOnMissing, tmpl.resolver)
 }
 
+// errMissingVariable is wrapped by the error for a name missing from the context.
+var errMissingVariable = errors.New("missing variable")
+
 // Evaluate interfaces and pointers looking for a value that can look up the name, via a
-// struct field, method, or map key, and return the result of the lookup.
-func lookup(contextChain []interface{}, name string, errorOnMissing bool) (reflect.Value, error) {
+// struct field, method, or map key, and return the result of the lookup. The resolver, if
+// any, is asked first for each value.
+func lookup(contextChain []interface{}, name string, errorOnMissing bool, resolver func(interface{}, string) (interface{}, bool)) (reflect.Value, error) {
 	// dot notation
 	if name != "." && strings.Contains(name, ".") {
 		parts := strings.SplitN(name, ".", 2)
 
-		v, err := lookup(contextChain, parts[0], errorOnMissing)
+		v, err := lookup(contextChain, parts[0], errorOnMissing, resolver)
 		if err != nil {
 			return v, err
 		}
-		return lookup([]interface{}{v}, parts[1], errorOnMissing)
+		return lookup([]interface{}{v}, parts[1], errorOnMissing, resolver)
 	}
 
 	defer func() {
@@ -546,52 +1860,197 @@ func lookup(contextChain []interface{}, name string, errorOnMissing bool) (refle
 		}
 	}()
 
-Outer:
 	for _, ctx := range contextChain {
-		v := ctx.(reflect.Value)
-		for v.IsValid() {
-			typ := v.Type()
-			if n := v.Type().NumMethod(); n > 0 {
-				for i := 0; i < n; i++ {
-					m := typ.Method(i)
-					mtyp := m.Type
-					if m.Name == name && mtyp.NumIn() == 1 {
-						return v.Method(i).Call(nil)[0], nil
-					}
-				}
+		for v := ctx.(reflect.Value); v.IsValid(); v = wrappedContext(v) {
+			if ret, ok := resolve(resolver, v, name); ok {
+				return ret, nil
 			}
-			if name == "." {
-				return v, nil
-			}
-			switch av := v; av.Kind() {
-			case reflect.Ptr:
-				v = av.Elem()
-			case reflect.Interface:
-				v = av.Elem()
-			case reflect.Struct:
-				ret := av.FieldByName(name)
-				if ret.IsValid() {
-					return ret, nil
-				}
-				continue Outer
-			case reflect.Map:
-				ret := av.MapIndex(reflect.ValueOf(name))
-				if ret.IsValid() {
-					return ret, nil
-				}
-				continue Outer
-			default:
-				continue Outer
+			if ret, ok := lookupIn(v, name); ok {
+				return ret, nil
 			}
 		}
 	}
 	if !errorOnMissing {
 		return reflect.Value{}, nil
 	}
-	return reflect.Value{}, fmt.Errorf("missing variable %q", name)
+	return reflect.Value{}, fmt.Errorf("%w %q", errMissingVariable, name)
+}
+
+// resolve asks the resolver set with WithNameResolver for the value of a name in a single context value.
+func resolve(resolver func(interface{}, string) (interface{}, bool), v reflect.Value, name string) (reflect.Value, bool) {
+	if resolver == nil || name == "." || !v.CanInterface() || v.Type() == dynamicContextType {
+		return reflect.Value{}, false
+	}
+	value, ok := resolver(v.Interface(), name)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	// a nil value is found, but empty
+	return reflect.ValueOf(&value).Elem(), true
+}
+
+// lookupIn looks up a name as a method, field or map key of a single context value, and reports whether it was found.
+func lookupIn(v reflect.Value, name string) (reflect.Value, bool) {
+	for v.IsValid() {
+		if v.Type() == dynamicContextType {
+			return v.Interface().(*dynamicContext).lookup(name)
+		}
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			// a nil anywhere in a chain of pointers has nothing to look up
+			return v, name == "."
+		}
+		typ := v.Type()
+		if n := v.Type().NumMethod(); n > 0 {
+			for i := 0; i < n; i++ {
+				m := typ.Method(i)
+				mtyp := m.Type
+				if m.Name == name && mtyp.NumIn() == 1 {
+					return callMethod(v.Method(i)), true
+				}
+			}
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.CanAddr() {
+			// as in Go, pointer methods can be called on addressable values
+			if m := v.Addr().MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 {
+				return callMethod(m), true
+			}
+		}
+		if name == "." {
+			return v, true
+		}
+		switch av := v; av.Kind() {
+		case reflect.Ptr:
+			v = av.Elem()
+		case reflect.Interface:
+			v = av.Elem()
+		case reflect.Struct:
+			ret := av.FieldByName(name)
+			return ret, ret.IsValid()
+		case reflect.Map:
+			ret := av.MapIndex(reflect.ValueOf(name))
+			return ret, ret.IsValid()
+		case reflect.Slice, reflect.Array:
+			// a name which is a number, as in {{points.0.x}}, is an index; negative and out of range ones are missing
+			i, err := strconv.ParseUint(name, 10, 0)
+			if err != nil || i >= uint64(av.Len()) {
+				return reflect.Value{}, false
+			}
+			return av.Index(int(i)), true
+		default:
+			return reflect.Value{}, false
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// A DynamicContext is a context which looks up names by calling a function, for data which is too large or expensive
+// to put in a map up front, such as rows in a database. The function is called with each name the template looks up
+// in the context, or the first part of a dotted name, and reports whether it has a value for it; if not, the name is
+// looked up in the next context as usual. It is called at most once for each name in a render, as the results are
+// kept until the render ends. A plain func(name string) (interface{}, bool) passed to Render is used in the same way.
+type DynamicContext func(name string) (interface{}, bool)
+
+// A dynamicContext holds a DynamicContext in the context chain, along with the values it has returned so far.
+type dynamicContext struct {
+	fn     func(string) (interface{}, bool)
+	values map[string]reflect.Value
+}
+
+var dynamicContextType = reflect.TypeOf((*dynamicContext)(nil))
+
+// lookup returns the value of a name in a dynamic context, calling its function the first time the name is looked up.
+func (dc *dynamicContext) lookup(name string) (reflect.Value, bool) {
+	if name == "." {
+		return reflect.Value{}, false
+	}
+	if v, ok := dc.values[name]; ok {
+		return v, v.IsValid()
+	}
+	var v reflect.Value
+	if value, ok := dc.fn(name); ok {
+		// a nil value is found, but empty
+		v = reflect.ValueOf(&value).Elem()
+	}
+	if dc.values == nil {
+		dc.values = make(map[string]reflect.Value)
+	}
+	dc.values[name] = v
+	return v, v.IsValid()
+}
+
+// callMethod calls a method without arguments found in a context, and returns its result. A method returning a value
+// and a bool, as in func() (string, bool), has the value only if the bool is true; otherwise it renders nothing and is
+// false in sections.
+func callMethod(m reflect.Value) reflect.Value {
+	out := m.Call(nil)
+	if len(out) == 2 && out[1].Kind() == reflect.Bool && !out[1].Bool() {
+		return reflect.Value{}
+	}
+	return addressable(out[0])
+}
+
+// addressable returns a struct returned by a method as an addressable copy, so that a dotted name can go on to call
+// its pointer methods.
+func addressable(v reflect.Value) reflect.Value {
+	if v.Kind() != reflect.Struct || v.CanAddr() {
+		return v
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Elem()
+}
+
+// A ViewModel is a context value which wraps other data, such as a struct with methods computing values for a template
+// from data held in an unexported field. Names the view model doesn't have are looked up in the value returned by
+// MustacheContext, which may itself be a ViewModel, before moving on to the next value in the context.
+type ViewModel interface {
+	MustacheContext() interface{}
+}
+
+// wrappedContext returns the value wrapped by a ViewModel, or an invalid Value if v isn't one.
+func wrappedContext(v reflect.Value) reflect.Value {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() || !v.CanInterface() {
+		return reflect.Value{}
+	}
+	vm, ok := v.Interface().(ViewModel)
+	if !ok && v.CanAddr() {
+		vm, ok = v.Addr().Interface().(ViewModel)
+	}
+	if !ok {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(vm.MustacheContext())
+}
+
+// sqlNull returns the value held by one of the database/sql Null types, such as sql.NullString, or an invalid Value if
+// it is null, so that it's treated as missing. Any other value is returned unchanged.
+func sqlNull(v reflect.Value) reflect.Value {
+	ind := indirect(v)
+	if !ind.IsValid() || ind.Type().PkgPath() != "database/sql" || !strings.HasPrefix(ind.Type().Name(), "Null") {
+		return v
+	}
+	valuer, ok := ind.Interface().(driver.Valuer)
+	if !ok {
+		return v
+	}
+	dv, err := valuer.Value()
+	if err != nil || dv == nil {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(dv)
 }
 
-func isEmpty(v reflect.Value) bool {
+func (tmpl *Template) isEmpty(v reflect.Value) bool {
+	if tmpl.truthyFunc != nil {
+		var value interface{}
+		if v.IsValid() && v.CanInterface() {
+			value = v.Interface()
+		}
+		return !tmpl.truthyFunc(value)
+	}
+	if _, present, ok := tmpl.typeString(v); ok {
+		return !present
+	}
 	if !v.IsValid() || v.Interface() == nil {
 		return true
 	}
@@ -604,12 +2063,36 @@ func isEmpty(v reflect.Value) bool {
 	case reflect.Array, reflect.Slice:
 		return val.Len() == 0
 	case reflect.String:
+		if tmpl.wsTruthy {
+			return val.Len() == 0
+		}
 		return len(strings.TrimSpace(val.String())) == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		if tmpl.zeroTruthy && valueInd.IsZero() {
+			return false
+		}
+		if tmpl.numThreshold != nil {
+			return toFloat(valueInd) <= *tmpl.numThreshold
+		}
+		return valueInd.IsZero()
 	default:
 		return valueInd.IsZero()
 	}
 }
 
+// toFloat returns the value of a number of any numeric kind as a float64.
+func toFloat(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
 func indirect(v reflect.Value) reflect.Value {
 loop:
 	for v.IsValid() {
@@ -625,25 +2108,90 @@ loop:
 	return v
 }
 
-func (tmpl *Template) renderSection(section *sectionElement, contextChain []interface{}, buf io.Writer) error {
-	value, err := lookup(contextChain, section.name, tmpl.errorOnMissing)
-	if err != nil {
+func (tmpl *Template) renderSection(section *sectionElement, contextChain []interface{}, buf io.Writer, state *renderState) error {
+	if section.args != nil {
+		return tmpl.renderBlockHelper(section, contextChain, buf, state)
+	}
+	strict := section.inverted && tmpl.strictInvert
+	value, err := tmpl.lookupName(contextChain, section.name, tmpl.errorOnMissing || strict)
+	value = sqlNull(value)
+	if !value.IsValid() && tmpl.logger != nil {
+		tmpl.logger.Debug("mustache: missing section", "name", section.name)
+	}
+	if !value.IsValid() && tmpl.passthrough {
+		_, err := io.WriteString(buf, section.src)
+		return err
+	}
+	if err != nil && !section.inverted {
+		// an inverted section is for when a value is missing, so it is rendered even with WithErrors
 		return err
 	}
+	if err != nil && strict {
+		// unless WithInvertedRequiresPresence is set, when it is only for a value which is present
+		if tmpl.errorOnMissing {
+			return err
+		}
+		return nil
+	}
+	if fn, ok := tmpl.sectionFilters[section.name]; ok {
+		value = filterList(value, fn)
+	}
+	switch section.helper {
+	case ifHelper:
+		if tmpl.isEmpty(value) {
+			return tmpl.renderElements(section.inverse, contextChain, buf, state)
+		}
+		return tmpl.renderElements(section.elems, contextChain, buf, state)
+	case unlessHelper:
+		if tmpl.isEmpty(value) {
+			return tmpl.renderElements(section.elems, contextChain, buf, state)
+		}
+		return tmpl.renderElements(section.inverse, contextChain, buf, state)
+	}
+	if seq := indirect(value); seq.IsValid() && isSeq(seq.Type()) && !seq.IsNil() &&
+		(section.helper == "" || section.helper == eachHelper) {
+		return tmpl.renderSequence(section, seqIterations(seq), contextChain, buf, state)
+	}
+	if tmpl.mapMode == AsPairs && section.helper == "" && indirect(value).Kind() == reflect.Map {
+		return tmpl.renderIterations(section, eachIterations(value), contextChain, buf, state)
+	}
+	switch section.helper {
+	case eachHelper:
+		return tmpl.renderIterations(section, eachIterations(value), contextChain, buf, state)
+	case fieldsHelper:
+		return tmpl.renderIterations(section, fieldIterations(value), contextChain, buf, state)
+	}
 	context := contextChain[0].(reflect.Value)
 	contexts := []interface{}{}
 	// if the value is nil, check if it's an inverted section
-	isEmpty := isEmpty(value)
-	if isEmpty && !section.inverted || !isEmpty && section.inverted {
+	empty := tmpl.isEmpty(value)
+	if empty && !section.inverted {
+		if tmpl.elseIsData(section, contextChain) {
+			return nil
+		}
+		return tmpl.renderElements(section.inverse, contextChain, buf, state)
+	} else if !empty && section.inverted {
 		return nil
+	} else if !section.inverted && section.helper == withHelper {
+		contexts = append(contexts, value)
 	} else if !section.inverted {
 		valueInd := indirect(value)
 		switch val := valueInd; val.Kind() {
 		case reflect.Slice:
+			if isBytes(val) {
+				contexts = append(contexts, value)
+				break
+			}
+			if err := tmpl.checkIterations(section, val.Len()); err != nil {
+				return err
+			}
 			for i := 0; i < val.Len(); i++ {
 				contexts = append(contexts, val.Index(i))
 			}
 		case reflect.Array:
+			if err := tmpl.checkIterations(section, val.Len()); err != nil {
+				return err
+			}
 			for i := 0; i < val.Len(); i++ {
 				contexts = append(contexts, val.Index(i))
 			}
@@ -653,25 +2201,28 @@ func (tmpl *Template) renderSection(section *sectionElement, contextChain []inte
 			var text bytes.Buffer
 			getSectionText(section.elems, &text)
 			render := func(text string) (string, error) {
-				templ, err := tmpl.parent.CompileString(text)
+				templ, err := tmpl.compileChild(tmpl.name, text)
 				if err != nil {
 					return "", err
 				}
 				var buf bytes.Buffer
-				err = templ.renderTemplate(contextChain, &buf)
+				err = templ.renderTemplate(contextChain, tmpl.limit(&buf), state)
 				if err != nil {
 					return "", err
 				}
 				return buf.String(), nil
 			}
+			if tmpl.logger != nil {
+				tmpl.logger.Debug("mustache: calling lambda", "name", section.name)
+			}
 			in := []reflect.Value{reflect.ValueOf(text.String()), reflect.ValueOf(render)}
 			res := val.Call(in)
 			res_str := res[0].String()
 			if !res[1].IsNil() {
 				return res[1].Interface().(error)
 			}
-			fmt.Fprintf(buf, "%s", res_str)
-			return nil
+			_, err := io.WriteString(buf, res_str)
+			return err
 		default:
 			// Spec: Non-false sections have their value at the top of context,
 			// accessible as {{.}} or through the parent context. This gives
@@ -682,20 +2233,302 @@ func (tmpl *Template) renderSection(section *sectionElement, contextChain []inte
 		contexts = append(contexts, context)
 	}
 
-	chain2 := make([]interface{}, len(contextChain)+1)
-	copy(chain2[1:], contextChain)
+	if !section.inverted && len(contexts) > 0 {
+		if err := tmpl.enterContext(section, state); err != nil {
+			return err
+		}
+		defer func() { state.contexts-- }()
+	}
+	depth := 1
+	if section.alias != "" {
+		depth = 2
+	}
+	chain2 := make([]interface{}, len(contextChain)+depth)
+	copy(chain2[depth:], contextChain)
 	// by default we execute the section
 	for _, ctx := range contexts {
 		chain2[0] = ctx
-		for _, elem := range section.elems {
-			if err := tmpl.renderElement(elem, chain2, buf); err != nil {
-				return err
+		if section.alias != "" {
+			// the value is bound to its name beneath it, so {{.}} is still the value
+			chain2[1] = reflect.Value{}
+			if v := ctx.(reflect.Value); v.CanInterface() {
+				chain2[1] = reflect.ValueOf(map[string]interface{}{section.alias: v.Interface()})
+			}
+		}
+		for _, elem := range tmpl.sectionBody(section, chain2) {
+			if err := tmpl.renderElement(elem, chain2, buf, state); err != nil {
+				return renderError(elem, err)
 			}
 		}
 	}
 	return nil
 }
 
+// sectionBody returns the elements to render for each value of a section which is not empty: the part before its
+// {{else}} tag, unless the {{else}} tag is taken as a variable, when it is the whole section.
+func (tmpl *Template) sectionBody(section *sectionElement, contextChain []interface{}) []interface{} {
+	if !tmpl.elseIsData(section, contextChain) {
+		return section.elems
+	}
+	elems := make([]interface{}, 0, len(section.elems)+1+len(section.inverse))
+	elems = append(append(elems, section.elems...), section.elseVar)
+	return append(elems, section.inverse...)
+}
+
+// elseIsData reports whether the {{else}} tag of a plain section is to be rendered as a variable, as it was before
+// sections could have an {{else}} part, because the data has a value named else.
+func (tmpl *Template) elseIsData(section *sectionElement, contextChain []interface{}) bool {
+	if section.elseVar == nil {
+		return false
+	}
+	_, err := tmpl.lookupName(contextChain, "else", true)
+	return err == nil
+}
+
+// An iteration is one of the elements of a value iterated over by an each or fields block.
+type iteration struct {
+	key   interface{} // nil for the elements of slices and arrays
+	value reflect.Value
+}
+
+// eachIterations returns the elements iterated over by an each block. Slices and arrays are iterated over in order,
+// and maps in order of their sorted keys. Any other value has no elements.
+func eachIterations(value reflect.Value) []iteration {
+	val := indirect(value)
+	var items []iteration
+	switch val.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			items = append(items, iteration{nil, val.Index(i)})
+		}
+	case reflect.Map:
+		for _, k := range sortedKeys(val) {
+			items = append(items, iteration{k.Interface(), val.MapIndex(k)})
+		}
+	}
+	return items
+}
+
+// fieldIterations returns the elements iterated over by a fields block: the exported fields of a struct, in the
+// order in which they are declared. The fields of embedded structs are included in place of the embedded struct
+// itself, unless they are shadowed by fields of the outer struct. Any other value has no elements.
+func fieldIterations(value reflect.Value) []iteration {
+	val := indirect(value)
+	if val.Kind() != reflect.Struct {
+		return nil
+	}
+	var items []iteration
+	for _, f := range visibleFields(val.Type(), val.Type(), nil, nil) {
+		fv, ok := fieldByIndex(val, f.Index)
+		if !ok || !fv.CanInterface() {
+			// promoted through a nil pointer or an unexported embedded struct
+			continue
+		}
+		items = append(items, iteration{f.Name, fv})
+	}
+	return items
+}
+
+// visibleFields returns the exported fields of the struct type t, which is embedded in root at the given index, or is
+// root itself, in the order in which they are declared, with the fields of embedded structs in place of the embedded
+// structs themselves, leaving out those which are shadowed in root. Each field's Index is its index in root.
+func visibleFields(root, t reflect.Type, index []int, seen []reflect.Type) []reflect.StructField {
+	for _, s := range seen {
+		if s == t {
+			return nil
+		}
+	}
+	seen = append(seen, t)
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		f.Index = append(append([]int{}, index...), i)
+		if f.Anonymous && indirectType(f.Type).Kind() == reflect.Struct {
+			fields = append(fields, visibleFields(root, indirectType(f.Type), f.Index, seen)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if vf, ok := root.FieldByName(f.Name); !ok || !reflect.DeepEqual(vf.Index, f.Index) {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// fieldByIndex returns the nested field of the struct v with the given index, and false if it is promoted through a
+// nil pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// filterList returns a slice of the elements of a slice or array for which fn returns true. Other values are returned
+// as they are.
+func filterList(v reflect.Value, fn func(interface{}) bool) reflect.Value {
+	list := indirect(v)
+	if !list.IsValid() || list.Kind() != reflect.Slice && list.Kind() != reflect.Array || isBytes(list) {
+		return v
+	}
+	filtered := reflect.MakeSlice(reflect.SliceOf(list.Type().Elem()), 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		if fn(list.Index(i).Interface()) {
+			filtered = reflect.Append(filtered, list.Index(i))
+		}
+	}
+	return filtered
+}
+
+// checkIterations returns an error if a section would iterate over n elements, more than the limit set with
+// WithMaxIterations.
+func (tmpl *Template) checkIterations(section *sectionElement, n int) error {
+	if tmpl.maxIterations > 0 && n > tmpl.maxIterations {
+		return fmt.Errorf("%w: %s has more than %d elements", ErrIterationLimitExceeded, section.name, tmpl.maxIterations)
+	}
+	return nil
+}
+
+// enterContext counts a section pushing values onto the context, returning an error if it would take the context
+// deeper than the limit set with WithMaxContextDepth. The caller decrements state.contexts when the section is done.
+func (tmpl *Template) enterContext(section *sectionElement, state *renderState) error {
+	if tmpl.maxContext > 0 && state.contexts >= tmpl.maxContext {
+		return fmt.Errorf("%w: %s is nested more than %d deep", ErrContextTooDeep, section.name, tmpl.maxContext)
+	}
+	state.contexts++
+	return nil
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// renderIterations renders the body of an each or fields block once for each element, with the element at the top
+// of the context and its @index, @key and @value bound beneath it. The inverted form renders only when there are no
+// elements.
+func (tmpl *Template) renderIterations(section *sectionElement, items []iteration, contextChain []interface{}, buf io.Writer, state *renderState) error {
+	if !section.inverted {
+		if err := tmpl.checkIterations(section, len(items)); err != nil {
+			return err
+		}
+	}
+	return tmpl.renderSequence(section, func(yield func(iteration) bool) {
+		for _, item := range items {
+			if !yield(item) {
+				return
+			}
+		}
+	}, contextChain, buf, state)
+}
+
+// renderSequence renders a section once for each iteration produced by a sequence, or once if it is inverted and the
+// sequence produces nothing, when the part of a section after {{else}} is also rendered. Iterations are rendered as
+// they are produced.
+func (tmpl *Template) renderSequence(section *sectionElement, seq func(yield func(iteration) bool), contextChain []interface{}, buf io.Writer, state *renderState) error {
+	if section.inverted {
+		empty := true
+		seq(func(iteration) bool {
+			empty = false
+			return false
+		})
+		if !empty {
+			return nil
+		}
+		return tmpl.renderElements(section.elems, contextChain, buf, state)
+	}
+
+	if err := tmpl.enterContext(section, state); err != nil {
+		return err
+	}
+	defer func() { state.contexts-- }()
+	chain2 := make([]interface{}, len(contextChain)+2)
+	copy(chain2[2:], contextChain)
+	i := 0
+	var err error
+	seq(func(item iteration) bool {
+		if err = tmpl.checkIterations(section, i+1); err != nil {
+			return false
+		}
+		meta := map[string]interface{}{"@index": i, "@value": item.value.Interface()}
+		if item.key != nil {
+			meta["@key"] = item.key
+		}
+		if section.alias != "" {
+			meta[section.alias] = item.value.Interface()
+		}
+		chain2[0] = item.value
+		chain2[1] = reflect.ValueOf(meta)
+		i++
+		err = tmpl.renderElements(tmpl.sectionBody(section, chain2), chain2, buf, state)
+		return err == nil
+	})
+	if err == nil && i == 0 && !tmpl.elseIsData(section, contextChain) {
+		return tmpl.renderElements(section.inverse, contextChain, buf, state)
+	}
+	return err
+}
+
+// isSeq reports whether a type has the signature of an iter.Seq or iter.Seq2: a function which takes a yield function
+// of one or two arguments returning bool, and returns nothing.
+func isSeq(t reflect.Type) bool {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	yield := t.In(0)
+	return yield.Kind() == reflect.Func && (yield.NumIn() == 1 || yield.NumIn() == 2) &&
+		yield.NumOut() == 1 && yield.Out(0).Kind() == reflect.Bool
+}
+
+// seqIterations returns a sequence of the elements produced by an iter.Seq, or of the keys and values produced by an
+// iter.Seq2.
+func seqIterations(seq reflect.Value) func(yield func(iteration) bool) {
+	return func(yield func(iteration) bool) {
+		yieldType := seq.Type().In(0)
+		fn := reflect.MakeFunc(yieldType, func(args []reflect.Value) []reflect.Value {
+			item := iteration{value: args[0]}
+			if len(args) == 2 {
+				item = iteration{args[0].Interface(), args[1]}
+			}
+			return []reflect.Value{reflect.ValueOf(yield(item))}
+		})
+		seq.Call([]reflect.Value{fn})
+	}
+}
+
+// sortedKeys returns the keys of a map, ordered numerically if they are numbers and lexically otherwise.
+func sortedKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := indirect(keys[i]), indirect(keys[j])
+		if a.Kind() == b.Kind() {
+			switch a.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				return a.Int() < b.Int()
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+				return a.Uint() < b.Uint()
+			case reflect.Float32, reflect.Float64:
+				return a.Float() < b.Float()
+			}
+		}
+		return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+	})
+	return keys
+}
+
+// JSONEscape writes data to dest escaped for use in a JSON string. As with encoding/json, each byte which is not part
+// of valid UTF-8 is written as the Unicode replacement character U+FFFD, so that the output is always valid JSON.
 func JSONEscape(dest io.Writer, data string) error {
 	for _, r := range data {
 		var err error
@@ -741,23 +2574,35 @@ func getElementText(element interface{}, buf io.Writer) {
 	case *textElement:
 		fmt.Fprintf(buf, "%s", elem.text)
 	case *varElement:
-		fmt.Fprintf(buf, "{{%s}}", elem.name)
+		fmt.Fprintf(buf, "{{%s}}", elem.tagText())
 	case *sectionElement:
 		if elem.inverted {
-			fmt.Fprintf(buf, "{{^%s}}", elem.name)
+			fmt.Fprintf(buf, "{{^%s}}", elem.tagText())
 		} else {
-			fmt.Fprintf(buf, "{{#%s}}", elem.name)
+			fmt.Fprintf(buf, "{{#%s}}", elem.tagText())
 		}
 		for _, nelem := range elem.elems {
 			getElementText(nelem, buf)
 		}
-		fmt.Fprintf(buf, "{{/%s}}", elem.name)
+		if elem.inverse != nil {
+			fmt.Fprint(buf, "{{else}}")
+			for _, nelem := range elem.inverse {
+				getElementText(nelem, buf)
+			}
+		}
+		fmt.Fprintf(buf, "{{/%s}}", elem.closingName())
 	case *Template:
 		fmt.Fprint(buf, "???")
 	}
 }
 
-func (tmpl *Template) renderElement(element interface{}, contextChain []interface{}, buf io.Writer) error {
+func (tmpl *Template) renderElement(element interface{}, contextChain []interface{}, buf io.Writer, state *renderState) error {
+	if state.stats != nil {
+		switch element.(type) {
+		case *varElement, *sectionElement, *partialElement:
+			state.stats.Tags++
+		}
+	}
 	switch elem := element.(type) {
 	case *textElement:
 		_, err := buf.Write(elem.text)
@@ -768,67 +2613,916 @@ func (tmpl *Template) renderElement(element interface{}, contextChain []interfac
 				fmt.Printf("Panic while looking up %q: %s\n", elem.name, r)
 			}
 		}()
-		val, err := lookup(contextChain, elem.name, tmpl.errorOnMissing)
+		var val reflect.Value
+		var err error
+		if elem.fn.IsValid() {
+			if val, err = tmpl.call(elem, contextChain); err != nil {
+				return err
+			}
+		} else {
+			val, err = tmpl.lookupName(contextChain, elem.name, tmpl.errorOnMissing || tmpl.collectMissing)
+			if tmpl.collectMissing && errors.Is(err, errMissingVariable) {
+				state.addMissing(elem, err)
+				err = nil
+			}
+			if err == nil && val.IsValid() && indirect(val).Kind() == reflect.Func {
+				if val, err = tmpl.callValue(elem.name, indirect(val)); err != nil {
+					return err
+				}
+			}
+		}
+		val = sqlNull(val)
+		if !val.IsValid() && tmpl.logger != nil {
+			tmpl.logger.Debug("mustache: missing variable", "name", elem.name)
+		}
+		if !val.IsValid() && tmpl.passthrough && !elem.fn.IsValid() {
+			_, err := io.WriteString(buf, elem.src)
+			return err
+		}
 		if err != nil {
 			return err
 		}
 
+		if val.IsValid() && (elem.helper == pluralHelper || elem.helper == ordinalHelper) {
+			s, err := tmpl.countText(elem, val)
+			if err != nil {
+				return err
+			}
+			return tmpl.escape(buf, elem.name, elem.raw, s)
+		}
+		if val.IsValid() && elem.helper == jsonHelper {
+			data, err := json.MarshalIndent(val.Interface(), "", "  ")
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", elem.helper, elem.name, err)
+			}
+			_, err = buf.Write(data)
+			return err
+		}
+		if val.IsValid() && tmpl.strictTypes && tmpl.outputMode != EscapeJSON && !printable(val) && !tmpl.hasTypeStringer(val) {
+			return fmt.Errorf("cannot interpolate %s of type %s", elem.name, indirect(val).Type())
+		}
 		if val.IsValid() {
-			if elem.raw {
-				fmt.Fprint(buf, val.Interface())
-			} else {
-				s := fmt.Sprint(val.Interface())
-				switch tmpl.outputMode {
-				case EscapeJSON:
-					if err = JSONEscape(buf, s); err != nil {
-						return err
-					}
-				case EscapeHTML:
-					template.HTMLEscape(buf, []byte(s))
-				case Raw:
-					if _, err = buf.Write([]byte(s)); err != nil {
-						return err
-					}
-				}
+			s, verbatim, err := tmpl.format(val)
+			if err != nil {
+				return err
+			}
+			if verbatim {
+				_, err := io.WriteString(buf, s)
+				return err
+			}
+			if tmpl.trimValues && indirect(val).Kind() == reflect.String {
+				s = strings.TrimSpace(s)
+			}
+			raw := elem.raw || tmpl.outputMode == EscapeHTML && isSafeHTML(val)
+			if elem.helper == safeHelper && tmpl.sanitizer != nil {
+				s, raw = tmpl.sanitizer(s), true
+			}
+			if err := tmpl.escape(buf, elem.name, raw, s); err != nil {
+				return err
 			}
 		}
 	case *sectionElement:
-		if err := tmpl.renderSection(elem, contextChain, buf); err != nil {
+		if err := tmpl.renderSection(elem, contextChain, buf, state); err != nil {
 			return err
 		}
 	case *partialElement:
-		partial, err := tmpl.getPartials(elem.prov, elem.name, elem.indent)
-		if err != nil {
-			if tmpl.errorOnMissing {
+		if state.plan != nil {
+			return tmpl.renderPartial(elem, contextChain, buf, state)
+		}
+		if tmpl.beforePartial != nil {
+			if err := tmpl.beforePartial(elem.name); err != nil {
 				return err
 			}
+		}
+		err := tmpl.renderPartial(elem, contextChain, buf, state)
+		if tmpl.afterPartial != nil {
+			if afterErr := tmpl.afterPartial(elem.name); err == nil {
+				err = afterErr
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// renderPartial renders the partial included by a partial tag.
+func (tmpl *Template) renderPartial(elem *partialElement, contextChain []interface{}, buf io.Writer, state *renderState) error {
+	if elem.context != "" {
+		val, err := tmpl.lookup(contextChain, elem.context)
+		if err != nil {
+			return err
+		}
+		val = sqlNull(val)
+		if !val.IsValid() {
 			return nil
 		}
-		if err := partial.renderTemplate(contextChain, buf); err != nil {
+		contextChain = []interface{}{val}
+	}
+	indent := expandTabs(elem.indent, tmpl.indentTabWidth)
+	if state.plan != nil {
+		if elem.name != selfPartial {
+			*state.plan = insertName(*state.plan, elem.name)
+		}
+		if elem.raw || indexOf(state.partials, elem.name) >= 0 {
+			// A partial already being rendered has been followed as far as it can be.
+			return nil
+		}
+	}
+	if elem.raw {
+		data, _, err := tmpl.getPartialSource(elem.prov, elem.name, indent)
+		if state.stats != nil {
+			state.stats.Partials++
+		}
+		if err != nil {
+			if !tmpl.errorOnMissing || elem.optional && errors.Is(err, ErrPartialNotFound) {
+				return nil
+			}
 			return err
 		}
+		_, err = io.WriteString(buf, data)
+		return err
 	}
-	return nil
+	if len(state.partials) >= maxPartialDepth {
+		return fmt.Errorf("partials nested more than %d deep", maxPartialDepth)
+	}
+	if elem.name == selfPartial {
+		partial, err := tmpl.indented(indent)
+		if err != nil {
+			return err
+		}
+		state.partials = append(state.partials, elem.name)
+		defer func() { state.partials = state.partials[:len(state.partials)-1] }()
+		return partial.renderTemplate(contextChain, buf, state)
+	}
+	partial, err := tmpl.getPartials(elem.prov, elem.name, indent)
+	if state.stats != nil {
+		state.stats.Partials++
+	}
+	if tmpl.logger != nil {
+		tmpl.logger.Debug("mustache: partial", "name", elem.name, "provider", fmt.Sprintf("%T", elem.prov),
+			"found", err == nil, "error", err)
+	}
+	if err != nil {
+		if state.plan != nil && errors.Is(err, ErrPartialNotFound) {
+			return nil
+		}
+		var pe *preprocessError
+		if !tmpl.errorOnMissing && !errors.As(err, &pe) || elem.optional && errors.Is(err, ErrPartialNotFound) {
+			return nil
+		}
+		if tmpl.missingPartial != nil && errors.Is(err, ErrPartialNotFound) {
+			_, err = io.WriteString(buf, tmpl.missingPartial(elem.name))
+		}
+		return err
+	}
+	state.partials = append(state.partials, elem.name)
+	defer func() { state.partials = state.partials[:len(state.partials)-1] }()
+	return partial.renderTemplate(contextChain, buf, state)
+}
+
+// renderBlockHelper calls a registered block helper, and writes what it returns.
+func (tmpl *Template) renderBlockHelper(section *sectionElement, contextChain []interface{}, buf io.Writer, state *renderState) error {
+	args := make([]interface{}, len(section.args))
+	for i, arg := range section.args {
+		if arg.literal {
+			args[i] = arg.text
+			continue
+		}
+		val, err := tmpl.lookup(contextChain, arg.text)
+		if err != nil {
+			return err
+		}
+		if val = sqlNull(val); val.IsValid() && val.CanInterface() {
+			args[i] = val.Interface()
+		}
+	}
+	var context interface{}
+	if len(contextChain) > 0 {
+		if val := contextChain[0].(reflect.Value); val.IsValid() && val.CanInterface() {
+			context = val.Interface()
+		}
+	}
+	renderer := func(elems []interface{}) BlockRenderFn {
+		return func(data ...interface{}) (string, error) {
+			chain := contextChain
+			if len(data) > 0 {
+				chain = append(newContextChain(data), contextChain...)
+			}
+			var out bytes.Buffer
+			if err := tmpl.renderElements(elems, chain, tmpl.limit(&out), state); err != nil {
+				return "", err
+			}
+			return out.String(), nil
+		}
+	}
+	s, err := tmpl.blockHelpers[section.helper](args, context, renderer(section.elems), renderer(section.inverse))
+	if err != nil {
+		return fmt.Errorf("%s: %w", section.helper, err)
+	}
+	_, err = io.WriteString(buf, s)
+	return err
+}
+
+// call calls the function registered with WithFuncs for a variable tag, and returns its result.
+func (tmpl *Template) call(elem *varElement, contextChain []interface{}) (result reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", elem.helper, r)
+		}
+	}()
+	t := elem.fn.Type()
+	n := t.NumIn()
+	if t.IsVariadic() && len(elem.args) < n-1 {
+		return reflect.Value{}, fmt.Errorf("%s: wrong number of arguments: want at least %d got %d", elem.helper, n-1,
+			len(elem.args))
+	} else if !t.IsVariadic() && len(elem.args) != n {
+		return reflect.Value{}, fmt.Errorf("%s: wrong number of arguments: want %d got %d", elem.helper, n, len(elem.args))
+	}
+	in := make([]reflect.Value, len(elem.args))
+	for i, arg := range elem.args {
+		var v reflect.Value
+		if arg.literal {
+			v = reflect.ValueOf(arg.text)
+		} else if c, ok := constant(arg.text); ok {
+			v = c
+		} else {
+			name := arg.text
+			if len(name) > 1 && name[0] == '.' {
+				name = name[1:]
+			}
+			if v, err = tmpl.lookup(contextChain, name); err != nil {
+				return reflect.Value{}, err
+			}
+			v = sqlNull(v)
+		}
+		var pt reflect.Type
+		if t.IsVariadic() && i >= n-1 {
+			pt = t.In(n - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		if in[i], err = convertArg(v, pt); err != nil {
+			return reflect.Value{}, fmt.Errorf("%s: argument %d: %w", elem.helper, i+1, err)
+		}
+	}
+	out := elem.fn.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, fmt.Errorf("%s: %w", elem.helper, out[1].Interface().(error))
+	}
+	return out[0], nil
+}
+
+// constant returns the value of an argument to a function which is a number, true, false or nil, as in text/template.
+func constant(text string) (reflect.Value, bool) {
+	switch text {
+	case "true":
+		return reflect.ValueOf(true), true
+	case "false":
+		return reflect.ValueOf(false), true
+	case "nil":
+		return reflect.Value{}, true
+	}
+	digits := strings.TrimLeft(text, "+-.")
+	if digits == "" || digits[0] < '0' || digits[0] > '9' {
+		return reflect.Value{}, false
+	}
+	if i, err := strconv.ParseInt(text, 0, 0); err == nil {
+		return reflect.ValueOf(int(i)), true
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return reflect.ValueOf(f), true
+	}
+	return reflect.Value{}, false
+}
+
+// convertArg converts a value to the type of the parameter it is passed as.
+func convertArg(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if !v.IsValid() {
+		return reflect.Zero(t), nil
+	}
+	for v.Kind() == reflect.Interface && !v.IsNil() && !v.Type().AssignableTo(t) {
+		v = v.Elem()
+	}
+	switch {
+	case v.Type().AssignableTo(t):
+		return v, nil
+	case v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Type().AssignableTo(t):
+		return v.Elem(), nil
+	case v.CanAddr() && v.Addr().Type().AssignableTo(t):
+		return v.Addr(), nil
+	case isNumber(v.Kind()) && isNumber(t.Kind()):
+		return v.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", v.Type(), t)
+}
+
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// printable reports whether a value is something that makes sense to interpolate: a value which isn't a struct, map,
+// slice, array, function or channel, or which knows how to format itself.
+func printable(v reflect.Value) bool {
+	if isBytes(indirect(v)) {
+		return true
+	}
+	switch indirect(v).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Func, reflect.Chan:
+	default:
+		return true
+	}
+	for v.IsValid() {
+		switch v.Interface().(type) {
+		case fmt.Stringer, encoding.TextMarshaler, error:
+			return true
+		}
+		if v.CanAddr() {
+			switch v.Addr().Interface().(type) {
+			case fmt.Stringer, encoding.TextMarshaler, error:
+				return true
+			}
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			break
+		}
+		v = v.Elem()
+	}
+	return false
+}
+
+// isBytes reports whether a value is a byte slice, which is interpolated and used in sections as a string.
+func isBytes(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8
+}
+
+// callValue calls a function which is the value of a variable, and returns its result to interpolate in its place. The
+// function must take no arguments and return one value, or a value and an error. A function with any other signature,
+// or a nil one, is treated as missing.
+func (tmpl *Template) callValue(name string, fn reflect.Value) (reflect.Value, error) {
+	t := fn.Type()
+	if fn.IsNil() || t.NumIn() != 0 || t.NumOut() == 0 || t.NumOut() > 2 || t.NumOut() == 2 && t.Out(1) != errorType {
+		if tmpl.logger != nil {
+			tmpl.logger.Debug("mustache: not calling function", "name", name, "type", t.String())
+		}
+		if tmpl.errorOnMissing {
+			return reflect.Value{}, fmt.Errorf("cannot call %s of type %s: it must take no arguments and return one "+
+				"value, or a value and an error", name, t)
+		}
+		return reflect.Value{}, nil
+	}
+	if tmpl.logger != nil {
+		tmpl.logger.Debug("mustache: calling function", "name", name, "type", t.String())
+	}
+	out := fn.Call(nil)
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, fmt.Errorf("%s: %w", name, out[1].Interface().(error))
+	}
+	return out[0], nil
+}
+
+// countText returns the text written by the plural and ordinal helpers for a value.
+func (tmpl *Template) countText(elem *varElement, val reflect.Value) (string, error) {
+	n, err := number(val)
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w", elem.helper, elem.name, err)
+	}
+	if elem.helper == ordinalHelper {
+		if n != math.Trunc(n) {
+			return "", fmt.Errorf("%s %s: %v is not a whole number", elem.helper, elem.name, n)
+		}
+		return Ordinal(int64(n)), nil
+	}
+	rule := tmpl.pluralRule
+	if rule == nil {
+		rule = EnglishPlural
+	}
+	i := rule(n)
+	if i < 0 {
+		i = 0
+	} else if i >= len(elem.args) {
+		i = len(elem.args) - 1
+	}
+	return elem.args[i].text, nil
+}
+
+// number returns the number held by a value of any integer or floating point type, or a string containing a number.
+func number(v reflect.Value) (float64, error) {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v.String()), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v.String())
+		}
+		return n, nil
+	}
+	if !v.IsValid() {
+		return 0, errors.New("nil is not a number")
+	}
+	return 0, fmt.Errorf("%s is not a number", v.Type())
+}
+
+// A PluralRule chooses which of the forms of a word given to the plural helper is used for a number, by returning its
+// index. Indexes past the last form choose the last form.
+type PluralRule func(n float64) int
+
+// EnglishPlural is the default PluralRule, which chooses the first form for 1 and the second for any other number,
+// as in {{plural count "message" "messages"}}.
+func EnglishPlural(n float64) int {
+	if n == 1 {
+		return 0
+	}
+	return 1
 }
 
-func (tmpl *Template) renderTemplate(contextChain []interface{}, buf io.Writer) error {
-	for _, elem := range tmpl.elems {
-		if err := tmpl.renderElement(elem, contextChain, buf); err != nil {
+// Ordinal returns an integer as an English ordinal number, such as 1st, 2nd, 3rd, 4th, 11th or 21st.
+func Ordinal(n int64) string {
+	suffix := "th"
+	abs := n
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs%100 < 11 || abs%100 > 13 {
+		switch abs % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return strconv.FormatInt(n, 10) + suffix
+}
+
+// typeString formats a value with the function set for its type with WithTypeStringer, if there is one.
+func (tmpl *Template) typeString(v reflect.Value) (s string, present bool, ok bool) {
+	fn, v := tmpl.typeStringer(v)
+	if fn == nil {
+		return "", false, false
+	}
+	s, present = fn(v.Interface())
+	return s, present, true
+}
+
+// hasTypeStringer reports whether a value is formatted with a function set with WithTypeStringer.
+func (tmpl *Template) hasTypeStringer(v reflect.Value) bool {
+	fn, _ := tmpl.typeStringer(v)
+	return fn != nil
+}
+
+// typeStringer returns the function set with WithTypeStringer for the type of a value, or of what it points to, and
+// the value of that type.
+func (tmpl *Template) typeStringer(v reflect.Value) (TypeStringer, reflect.Value) {
+	if tmpl.typeStringers == nil {
+		return nil, v
+	}
+	for v.IsValid() {
+		if fn, ok := tmpl.typeStringers[v.Type()]; ok && v.CanInterface() {
+			return fn, v
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface || v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+	return nil, v
+}
+
+// format returns the text of an interpolated value. Pointers are formatted as the value they point to, and nil as
+// nothing, and an error with its Error method, even if the method has a pointer receiver. In JSON mode, a value
+// implementing json.Marshaler is formatted with MarshalJSON, and is to be written verbatim unless the result is a JSON
+// string; a value implementing only encoding.TextMarshaler is formatted with MarshalText. A byte slice is formatted as
+// the string it holds, or in JSON mode as base64, as encoding/json encodes it. A function set with WithTypeStringer
+// takes precedence over all of these.
+func (tmpl *Template) format(v reflect.Value) (string, bool, error) {
+	if s, present, ok := tmpl.typeString(v); ok {
+		if !present {
+			s = ""
+		}
+		return s, false, nil
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return "", false, nil
+	}
+	i := v.Interface()
+	if err, ok := i.(error); ok {
+		return err.Error(), false, nil
+	}
+	if v.CanAddr() {
+		if err, ok := v.Addr().Interface().(error); ok {
+			return err.Error(), false, nil
+		}
+	}
+	if tmpl.outputMode == EscapeJSON {
+		switch m := i.(type) {
+		case json.Marshaler:
+			b, err := m.MarshalJSON()
+			if err != nil {
+				return "", false, err
+			}
+			var s string
+			if json.Unmarshal(b, &s) == nil {
+				return s, false, nil
+			}
+			return string(b), true, nil
+		case encoding.TextMarshaler:
+			b, err := m.MarshalText()
+			if err != nil {
+				return "", false, err
+			}
+			return string(b), false, nil
+		}
+	}
+	if b := indirect(v); isBytes(b) {
+		if _, ok := i.(fmt.Stringer); !ok {
+			if tmpl.outputMode == EscapeJSON {
+				return base64.StdEncoding.EncodeToString(b.Bytes()), false, nil
+			}
+			return string(b.Bytes()), false, nil
+		}
+	}
+	if b := indirect(v); tmpl.boolStrings != nil && b.Kind() == reflect.Bool {
+		if _, ok := i.(fmt.Stringer); !ok {
+			if b.Bool() {
+				return tmpl.boolStrings[0], false, nil
+			}
+			return tmpl.boolStrings[1], false, nil
+		}
+	}
+	if _, ok := i.(fmt.Stringer); !ok && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		// format the value pointed to, such as that of an optional *int field, rather than the pointer
+		d := indirect(v)
+		if !d.IsValid() {
+			return "", false, nil
+		}
+		if d.CanInterface() {
+			i = d.Interface()
+		}
+	}
+	return fmt.Sprint(i), false, nil
+}
+
+// escape writes the value of the named tag to the output, escaped according to the template's settings.
+func (tmpl *Template) escape(w io.Writer, name string, raw bool, s string) error {
+	if tmpl.tagEscapeFunc != nil {
+		return tmpl.tagEscapeFunc(w, name, raw, s)
+	}
+	if raw {
+		_, err := io.WriteString(w, s)
+		return err
+	}
+	if tmpl.escapeFunc != nil {
+		return tmpl.escapeFunc(w, s)
+	}
+	switch tmpl.outputMode {
+	case EscapeJSON:
+		return JSONEscape(w, s)
+	case EscapeHTML:
+		if tmpl.htmlEscaper != nil {
+			_, err := tmpl.htmlEscaper.WriteString(w, s)
 			return err
 		}
+		_, err := io.WriteString(w, template.HTMLEscapeString(s))
+		return err
+	case EscapeHTMLAttr:
+		_, err := htmlAttrEscaper.WriteString(w, s)
+		return err
+	default:
+		_, err := io.WriteString(w, s)
+		return err
+	}
+}
+
+func (tmpl *Template) renderElements(elems []interface{}, contextChain []interface{}, buf io.Writer, state *renderState) error {
+	for _, elem := range elems {
+		if err := tmpl.renderElement(elem, contextChain, buf, state); err != nil {
+			return renderError(elem, err)
+		}
 	}
 	return nil
 }
 
+// A RenderError is returned when a tag fails to render, such as a missing variable when WithErrors is set. It gives
+// the line of the tag, and the path of partials by which it was included.
+type RenderError struct {
+	// Path holds the name of the template, if it was compiled from a file, followed by the names of the partials
+	// included to reach the tag, outermost first.
+	Path []string
+	Line int   // The line of the tag in the template or partial it appears in
+	Err  error // The cause of the failure
+}
+
+func (e *RenderError) Error() string {
+	if len(e.Path) == 0 {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: line %d: %v", strings.Join(e.Path, " > "), e.Line, e.Err)
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// renderError returns the error from rendering an element as a RenderError giving its position. An error from the
+// elements inside a partial has the name of the partial added to its path.
+func renderError(elem interface{}, err error) error {
+	if re, ok := err.(*RenderError); ok {
+		if pe, ok := elem.(*partialElement); ok {
+			re.Path = append([]string{pe.name}, re.Path...)
+		}
+		return re
+	}
+	switch elem := elem.(type) {
+	case *varElement:
+		return &RenderError{Line: elem.line, Err: err}
+	case *sectionElement:
+		return &RenderError{Line: elem.startline, Err: err}
+	case *partialElement:
+		return &RenderError{Line: elem.line, Err: err}
+	}
+	return err
+}
+
+// rootError adds the name of the template to the path of a RenderError from rendering it, if it has one.
+func (tmpl *Template) rootError(err error) error {
+	if re, ok := err.(*RenderError); ok && tmpl.name != "" {
+		re.Path = append([]string{tmpl.name}, re.Path...)
+	}
+	return err
+}
+
+func (tmpl *Template) renderTemplate(contextChain []interface{}, buf io.Writer, state *renderState) error {
+	return tmpl.renderElements(tmpl.elems, contextChain, buf, state)
+}
+
 // Frender uses the given data source - generally a map or struct - to
-// render the compiled template to an io.Writer.
+// render the compiled template to an io.Writer. A data source which is
+// already a reflect.Value is used as is. The output is written straight to
+// the writer, so rendering into a *strings.Builder doesn't copy it.
 func (tmpl *Template) Frender(out io.Writer, context ...interface{}) error {
+	state := &renderState{}
+	return tmpl.result(state, tmpl.renderTemplate(tmpl.rootChain(context), tmpl.limit(out), state))
+}
+
+// FrenderAtomic is like Frender, but renders the whole template before writing any of it, so that nothing is written
+// to out if rendering fails, for a file or network connection which shouldn't be left half written. The output is held
+// in memory until then.
+func (tmpl *Template) FrenderAtomic(out io.Writer, context ...interface{}) error {
+	var buf bytes.Buffer
+	if err := tmpl.Frender(&buf, context...); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(out)
+	return err
+}
+
+// renderState holds the state of a single call to render a template, which is shared with the partials it includes.
+type renderState struct {
+	stats    *RenderStats // nil unless the caller asked for them
+	partials []string     // The names of the partials being rendered, one inside another, outermost first
+	missing  []error      // The missing variables found, with WithCollectMissing
+	plan     *[]string    // With PlanPartials, the sorted names of the partials the render would fetch
+	contexts int          // The number of values pushed onto the context by the sections being rendered
+}
+
+// addMissing records a variable missing from the context, once for each tag.
+func (s *renderState) addMissing(elem *varElement, err error) {
+	re := &RenderError{Path: append([]string(nil), s.partials...), Line: elem.line, Err: err}
+	for _, e := range s.missing {
+		if e.Error() == re.Error() {
+			return
+		}
+	}
+	s.missing = append(s.missing, re)
+}
+
+// result returns the error from a render which ended with err, along with those for any missing variables it found,
+// with the name of the template added to their paths.
+func (tmpl *Template) result(state *renderState, err error) error {
+	if len(state.missing) == 0 {
+		return tmpl.rootError(err)
+	}
+	errs := make([]error, 0, len(state.missing)+1)
+	for _, e := range state.missing {
+		errs = append(errs, tmpl.rootError(e))
+	}
+	if err != nil {
+		errs = append(errs, tmpl.rootError(err))
+	}
+	return joinErrors(errs...)
+}
+
+// maxPartialDepth is the deepest partials may be nested when rendering, which stops a partial which includes itself
+// without end.
+const maxPartialDepth = 100
+
+// RenderStats describes the work done to render a template.
+type RenderStats struct {
+	Tags     int           // The number of variables, sections and partials evaluated, including those in partials
+	Partials int           // The number of partials fetched from the partial provider
+	Bytes    int           // The number of bytes written
+	Duration time.Duration // The time taken to render the template
+}
+
+// RenderStats is like Render, but also returns statistics about the work
+// done to render the template.
+func (tmpl *Template) RenderStats(context ...interface{}) (string, RenderStats, error) {
+	var stats RenderStats
+	var buf bytes.Buffer
+	start := time.Now()
+	state := &renderState{stats: &stats}
+	err := tmpl.result(state, tmpl.renderTemplate(tmpl.rootChain(context), tmpl.limit(&buf), state))
+	stats.Duration = time.Since(start)
+	stats.Bytes = buf.Len()
+	return buf.String(), stats, err
+}
+
+// PlanPartials reports the sorted names of the partials which rendering the template with the given data would fetch,
+// following those they include in turn, without writing any output or calling the hooks set with WithPartialHooks.
+func (tmpl *Template) PlanPartials(context ...interface{}) ([]string, error) {
+	plan := []string{}
+	state := &renderState{plan: &plan}
+	if err := tmpl.result(state, tmpl.renderTemplate(tmpl.rootChain(context), io.Discard, state)); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// FrenderN is like Frender, but also returns the number of bytes written.
+func (tmpl *Template) FrenderN(out io.Writer, context ...interface{}) (int, error) {
+	cw := &countingWriter{w: out}
+	err := tmpl.Frender(cw, context...)
+	return int(cw.n), err
+}
+
+// RenderSize renders the compiled template using the given data source and
+// returns the size of the output in bytes, without keeping the output.
+func (tmpl *Template) RenderSize(context ...interface{}) (int, error) {
+	return tmpl.FrenderN(io.Discard, context...)
+}
+
+// FrenderNamed is like Frender, but renders the template defined in the
+// compiled template with {{#define "name"}}...{{/define}}.
+func (tmpl *Template) FrenderNamed(out io.Writer, name string, context ...interface{}) error {
+	elems, ok := tmpl.defines[name]
+	if !ok {
+		return fmt.Errorf("no template defined as %q", name)
+	}
+	state := &renderState{}
+	return tmpl.result(state, tmpl.renderElements(elems, tmpl.rootChain(context), tmpl.limit(out), state))
+}
+
+// RenderNamed is like Render, but renders the template defined in the
+// compiled template with {{#define "name"}}...{{/define}}.
+func (tmpl *Template) RenderNamed(name string, context ...interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.FrenderNamed(&buf, name, context...)
+	return buf.String(), err
+}
+
+// FrenderSection is like Frender, but renders only the body of one section of the template, as if it were the whole
+// template, with the data as its context, so that a single list or block can be tested on its own. The section is
+// named by the names of the sections leading to it, joined with dots, as in "content.items" for {{#items}} inside
+// {{#content}}. Sections of helpers, such as {{#if}}, are not included in the path and can't be rendered this way.
+func (tmpl *Template) FrenderSection(out io.Writer, path string, context ...interface{}) error {
+	section := findSection(tmpl.elems, path)
+	if section == nil {
+		return fmt.Errorf("no section %q in template", path)
+	}
+	state := &renderState{}
+	return tmpl.result(state, tmpl.renderElements(section.elems, tmpl.rootChain(context), tmpl.limit(out), state))
+}
+
+// RenderSection is like Render, but renders only the body of one section of the template, as described for
+// FrenderSection.
+func (tmpl *Template) RenderSection(path string, context ...interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.FrenderSection(&buf, path, context...)
+	return buf.String(), err
+}
+
+// findSection returns the first section, in the order of the template, at the end of a dotted path of section names,
+// or nil if there is none. A section whose own name is dotted, such as {{#user.roles}}, takes up several parts.
+func findSection(elems []interface{}, path string) *sectionElement {
+	for _, element := range elems {
+		se, ok := element.(*sectionElement)
+		if !ok || se.helper != "" {
+			continue
+		}
+		if se.name == path {
+			return se
+		}
+		if strings.HasPrefix(path, se.name+".") {
+			if found := findSection(se.elems, path[len(se.name)+1:]); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+func newContextChain(context []interface{}) []interface{} {
 	var contextChain []interface{}
 	for _, c := range context {
-		val := reflect.ValueOf(c)
+		val, ok := c.(reflect.Value)
+		if !ok {
+			val = reflect.ValueOf(c)
+		}
+		switch fn := c.(type) {
+		case func(string) (interface{}, bool):
+			val = reflect.ValueOf(&dynamicContext{fn: fn})
+		case DynamicContext:
+			val = reflect.ValueOf(&dynamicContext{fn: fn})
+		}
 		contextChain = append(contextChain, val)
 	}
-	return tmpl.renderTemplate(contextChain, out)
+	return contextChain
+}
+
+// rootChain returns the context chain to render the template with: the data sources, followed by the @template
+// variables of a template compiled from a file, which give its path, the directory it is in and its base name.
+func (tmpl *Template) rootChain(context []interface{}) []interface{} {
+	chain := newContextChain(context)
+	if tmpl.name != "" {
+		name := filepath.ToSlash(tmpl.name)
+		meta := map[string]interface{}{
+			"@template": map[string]string{"path": name, "dir": path.Dir(name), "name": path.Base(name)},
+		}
+		chain = append(chain, reflect.ValueOf(meta))
+	}
+	return chain
+}
+
+// limit applies the template's output limit, if any, to a writer.
+func (tmpl *Template) limit(w io.Writer) io.Writer {
+	if tmpl.maxOutput <= 0 {
+		return w
+	}
+	return &limitWriter{w, tmpl.maxOutput}
+}
+
+// limitWriter passes writes through to w until n bytes have been written, after which it fails with
+// ErrOutputTooLarge.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= lw.n {
+		n, err := lw.w.Write(p)
+		lw.n -= int64(n)
+		return n, err
+	}
+	n, err := lw.w.Write(p[:lw.n])
+	lw.n -= int64(n)
+	if err == nil {
+		err = ErrOutputTooLarge
+	}
+	return n, err
+}
+
+// WriterTo returns an io.WriterTo which renders the compiled template using
+// the given data source each time its WriteTo method is called. Errors from
+// rendering are returned by WriteTo.
+func (tmpl *Template) WriterTo(context ...interface{}) io.WriterTo {
+	return &templateWriterTo{tmpl, context}
+}
+
+type templateWriterTo struct {
+	tmpl    *Template
+	context []interface{}
+}
+
+func (wt *templateWriterTo) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := wt.tmpl.Frender(cw, wt.context...)
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
 }
 
 // Render uses the given data source - generally a map or struct - to render
@@ -839,6 +3533,15 @@ func (tmpl *Template) Render(context ...interface{}) (string, error) {
 	return buf.String(), err
 }
 
+// RenderPartial is like Render, but guarantees that if rendering fails, the
+// output rendered up to the point of failure is returned with the error, so
+// that a preview of a template being edited can show how far it got.
+func (tmpl *Template) RenderPartial(context ...interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Frender(&buf, context...)
+	return buf.String(), err
+}
+
 // RenderInLayout uses the given data source - generally a map or struct - to
 // render the compiled template and layout "wrapper" template and return the
 // output.
@@ -855,12 +3558,46 @@ func (tmpl *Template) RenderInLayout(layout *Template, context ...interface{}) (
 // struct - to render the compiled templated a loayout "wrapper"
 // template to an io.Writer.
 func (tmpl *Template) FRenderInLayout(out io.Writer, layout *Template, context ...interface{}) error {
+	return tmpl.FRenderInLayouts(out, []*Template{layout}, context...)
+}
+
+// RenderInLayouts is like RenderInLayout, but wraps the compiled template
+// in each of a list of layouts in turn, innermost first, and returns the
+// output.
+func (tmpl *Template) RenderInLayouts(layouts []*Template, context ...interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.FRenderInLayouts(&buf, layouts, context...)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// FRenderInLayouts is like FRenderInLayout, but wraps the compiled
+// template in each of a list of layouts in turn, innermost first. Each
+// layout is given the output of the one before it as "content", or the
+// name set with WithLayoutSlot, along with the given data source.
+func (tmpl *Template) FRenderInLayouts(out io.Writer, layouts []*Template, context ...interface{}) error {
 	content, err := tmpl.Render(context...)
 	if err != nil {
 		return err
 	}
-	allContext := make([]interface{}, len(context)+1)
-	copy(allContext[1:], context)
-	allContext[0] = map[string]string{"content": content}
-	return layout.Frender(out, allContext...)
+	for i, layout := range layouts {
+		allContext := make([]interface{}, len(context)+1)
+		copy(allContext[1:], context)
+		slot := layout.layoutSlot
+		if slot == "" {
+			slot = "content"
+		}
+		allContext[0] = map[string]string{slot: content}
+		if i == len(layouts)-1 {
+			return layout.Frender(out, allContext...)
+		}
+		content, err = layout.Render(allContext...)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(out, content)
+	return err
 }
@@ -2,11 +2,25 @@ package mustache
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
 )
 
 type Test struct {
@@ -97,6 +111,9 @@ var tests = []Test{
 	{`{{{var}}}`, map[string]string{"var": "5 > 2"}, "5 > 2", nil},
 	{`{{var}}`, map[string]string{"var": "& \" < >"}, "&amp; &#34; &lt; &gt;", nil},
 	{`{{{var}}}`, map[string]string{"var": "& \" < >"}, "& \" < >", nil},
+	{`{{&var}}`, map[string]string{"var": "5 > 2"}, "5 > 2", nil},
+	{`{{&var}}`, map[string]string{"var": "& \" < >"}, "& \" < >", nil},
+	{`{{& var }}|{{&  var}}|{{{ var }}}`, map[string]string{"var": "<b>"}, "<b>|<b>|<b>", nil},
 	{`{{a}}{{b}}{{c}}{{d}}`, map[string]string{"a": "a", "b": "b", "c": "c", "d": "d"}, "abcd", nil},
 	{`0{{a}}1{{b}}23{{c}}456{{d}}89`, map[string]string{"a": "a", "b": "b", "c": "c", "d": "d"}, "0a1b23c456d89", nil},
 	{`hello {{! comment }}world`, map[string]string{}, "hello world", nil},
@@ -107,6 +124,7 @@ var tests = []Test{
 	{`{{#A}}`, Data{true, "hello"}, "", parseError{line: 1, message: "Section A has no closing tag"}},
 	{`{{#A}}{{B}}{{/A}}`, Data{true, "hello"}, "hello", nil},
 	{`{{#A}}{{{B}}}{{/A}}`, Data{true, "5 > 2"}, "5 > 2", nil},
+	{`{{#A}}{{&B}}{{/A}}`, Data{true, "5 > 2"}, "5 > 2", nil},
 	{`{{#A}}{{B}}{{/A}}`, Data{true, "5 > 2"}, "5 &gt; 2", nil},
 	{`{{#A}}{{B}}{{/A}}`, Data{false, "hello"}, "", nil},
 	{`{{a}}{{#b}}{{b}}{{/b}}{{c}}`, map[string]string{"a": "a", "b": "b", "c": "c"}, "abc", nil},
@@ -223,6 +241,7 @@ var tests = []Test{
 	// dotted names(dot notation)
 	{`"{{person.name}}" == "{{#person}}{{name}}{{/person}}"`, map[string]interface{}{"person": map[string]string{"name": "Joe"}}, `"Joe" == "Joe"`, nil},
 	{`"{{{person.name}}}" == "{{#person}}{{{name}}}{{/person}}"`, map[string]interface{}{"person": map[string]string{"name": "Joe"}}, `"Joe" == "Joe"`, nil},
+	{`"{{&person.name}}" == "{{#person}}{{&name}}{{/person}}"`, map[string]interface{}{"person": map[string]string{"name": "<Joe>"}}, `"<Joe>" == "<Joe>"`, nil},
 	{`"{{a.b.c.d.e.name}}" == "Phil"`, map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": map[string]interface{}{"d": map[string]interface{}{"e": map[string]string{"name": "Phil"}}}}}}, `"Phil" == "Phil"`, nil},
 	{`"{{#a}}{{b.c.d.e.name}}{{/a}}" == "Phil"`, map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": map[string]interface{}{"d": map[string]interface{}{"e": map[string]string{"name": "Phil"}}}}}, "b": map[string]interface{}{"c": map[string]interface{}{"d": map[string]interface{}{"e": map[string]string{"name": "Wrong"}}}}}, `"Phil" == "Phil"`, nil},
 }
@@ -301,6 +320,49 @@ func TestMissing(t *testing.T) {
 	}
 }
 
+func TestInvertedFalsy(t *testing.T) {
+	type record struct {
+		Nil   *User
+		Iface interface{}
+		False bool
+		Empty string
+		List  []string
+	}
+	contexts := map[string]interface{}{
+		"map": map[string]interface{}{
+			"nil": nil, "nilMap": map[string]int(nil), "false": false, "empty": "", "list": []string{},
+		},
+		"struct": record{},
+	}
+	names := map[string][]string{
+		"map":    {"absent", "nil", "nilMap", "false", "empty", "list", "absent.name", "list.0"},
+		"struct": {"Absent", "Nil", "Iface", "False", "Empty", "List", "Nil.Name", "List.0"},
+	}
+	for _, strict := range []bool{false, true} {
+		for kind, context := range contexts {
+			for _, name := range names[kind] {
+				tmpl, err := New().WithErrors(strict).CompileString("{{^" + name + "}}none{{/" + name + "}}")
+				if err != nil {
+					t.Fatal(err)
+				}
+				output, err := tmpl.Render(context)
+				if err != nil || output != "none" {
+					t.Errorf("%s %s with errors %v: expected %q got %q, %v", kind, name, strict, "none", output, err)
+				}
+			}
+		}
+	}
+
+	// Only the inverted section is rendered for a missing name when errors are enabled.
+	tmpl, err := New().WithErrors(true).CompileString("{{#absent}}some{{/absent}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(contexts["map"]); err == nil || !strings.Contains(err.Error(), `missing variable "absent"`) {
+		t.Errorf("expected a missing variable error, got %v", err)
+	}
+}
+
 func TestFile(t *testing.T) {
 	filename := path.Join(path.Join(os.Getenv("PWD"), "tests"), "test1.mustache")
 	expected := "hello world"
@@ -316,6 +378,51 @@ func TestFile(t *testing.T) {
 	}
 }
 
+func TestEscapeByExtension(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.html":         {Data: []byte(`<p>{{v}}</p>{{>quote}}`)},
+		"a.txt":          {Data: []byte(`{{v}}`)},
+		"a.json":         {Data: []byte(`{"v": "{{v}}"}{{>quote}}`)},
+		"a.mustache":     {Data: []byte(`{{v}}`)},
+		"quote.mustache": {Data: []byte(`{{q}}`)},
+	}
+	cmpl := New().WithPartials(&FileProvider{FS: fsys}).WithEscapeByExtension(map[string]EscapeMode{
+		".txt":  Raw,
+		".json": EscapeJSON,
+	})
+	context := map[string]string{"v": `"5 > 2"`, "q": `"`}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"a.html", `<p>&#34;5 &gt; 2&#34;</p>&#34;`},
+		{"a.txt", `"5 > 2"`},
+		{"a.json", `{"v": "\"5 > 2\""}\"`},
+		{"a.mustache", `&#34;5 &gt; 2&#34;`},
+	}
+	for _, test := range tests {
+		tmpl, err := cmpl.CompileFS(fsys, test.name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%s expected %q got %q", test.name, test.expected, output)
+		}
+	}
+
+	tmpl, err := cmpl.CompileFile(path.Join("tests", "test1.mustache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.outputMode != EscapeHTML {
+		t.Errorf("expected the default escape mode for an unlisted extension")
+	}
+}
+
 func TestFRender(t *testing.T) {
 	filename := path.Join(path.Join(os.Getenv("PWD"), "tests"), "test1.mustache")
 	expected := "hello world"
@@ -367,322 +474,4356 @@ func TestPartial(t *testing.T) {
 	compareTags(t, tmpl.Tags(), expectedTags)
 }
 
-func TestPartialSafety(t *testing.T) {
-	tmpl, err := New().WithErrors(true).WithPartials(&FileProvider{}).CompileString("{{>../unsafe}}")
+func TestPartialContext(t *testing.T) {
+	sp := &StaticProvider{map[string]string{
+		"user":        "{{Name}} ({{ID}}){{#Address}}, {{City}}{{/Address}}{{title}}",
+		"site footer": "Footer{{title}}",
+	}}
+	context := map[string]interface{}{
+		"title":  "!",
+		"person": map[string]interface{}{"Name": "Mike", "ID": 1, "Address": map[string]string{"City": "Austin"}},
+		"admin":  &User{"Ann", 2},
+	}
+	tests := []struct {
+		tmpl     string
+		errors   bool
+		expected string
+		err      bool
+	}{
+		{`{{>user person}}`, false, "Mike (1), Austin", false},
+		{`{{> user  admin }}`, false, "Ann (2)", false},
+		{`{{#person}}{{>user}}{{/person}}`, false, "Mike (1), Austin!", false},
+		{`[{{>user nobody}}]`, false, "[]", false},
+		{`[{{>user nobody}}]`, true, "[", true},
+		{`{{>site footer}}`, true, "Footer!", false},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithPartials(sp).WithErrors(test.errors).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if (err != nil) != test.err {
+			t.Errorf("%q expected error %v got %v", test.tmpl, test.err, err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestValidatePartials(t *testing.T) {
+	partials := &StaticProvider{Partials: map[string]string{
+		"page":   "{{>header}}{{#user}}{{>card}}{{/user}}{{>?missing}}{{>&raw}}",
+		"header": "<h1>{{title}}</h1>{{>nav}}",
+		"nav":    "{{#links}}\n{{.}}\n{{/link}}",
+		"card":   "{{name}}\n{{{bad}}\n{{>page}}",
+		"raw":    "{{#not compiled",
+	}}
+	cmpl := New().WithPartials(partials)
+	tmpl, err := cmpl.CompileString("{{>page}}")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	txt, err := tmpl.Render(nil)
-	if err == nil {
-		t.Errorf("expected error for unsafe partial")
+	err = tmpl.ValidatePartials()
+	expected := "card: line 2: unmatched open tag\nnav: line 3: interleaved closing tag: link"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected errors %q got %v", expected, err)
 	}
-	if txt != "" {
-		t.Errorf("expected unsafe partial to fail")
+
+	tmpl, err = cmpl.CompileString("{{>header}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partials.Partials["nav"] = "{{#links}}{{.}}{{/links}}"
+	if err := tmpl.ValidatePartials(); err != nil {
+		t.Errorf("expected no errors, got %v", err)
 	}
 }
 
-func TestPartialSafetyWindows(t *testing.T) {
-	tmpl, err := New().WithErrors(true).WithPartials(&FileProvider{}).CompileString("{{>spec/..\\..\\test.txt}}")
+func TestBakePartials(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"header.mustache": "<h1>{{title}}</h1>{{>nav}}{{>&footer}}",
+		"nav.mustache":    "{{#links}}<a>{{.}}</a>{{/links}}{{>?extra}}",
+		"footer.mustache": "{{not compiled",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := "{{>header}}{{#sub}}{{>nav}}{{/sub}}"
+	sp, err := New().BakePartials(source, &FileProvider{Paths: []string{dir}, Extensions: []string{".mustache"}})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	txt, err := tmpl.Render(nil)
-	if err == nil {
-		t.Errorf("expected error for unsafe partial")
+	expected := map[string]string{
+		"header": files["header.mustache"],
+		"nav":    files["nav.mustache"],
+		"footer": files["footer.mustache"],
 	}
-	if txt != "" {
-		t.Errorf("expected unsafe partial to fail")
+	if !reflect.DeepEqual(sp.Partials, expected) {
+		t.Errorf("expected %q got %q", expected, sp.Partials)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := New().WithPartials(sp).WithErrors(true).CompileString(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]interface{}{"title": "Hi", "links": []string{"x"}, "sub": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<h1>Hi</h1><a>x</a>{{not compiled"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+
+	partials := &StrictStaticProvider{map[string]string{"a": "{{>b}}", "b": "{{#x}}{{>a}}{{/x}}", "c": "{{>d}}{{>e}}"}}
+	_, err = New().BakePartials("{{>a}}", partials)
+	if expected := "partial cycle: a > b > a"; err == nil || err.Error() != expected {
+		t.Errorf("expected %q got %v", expected, err)
+	}
+	_, err = New().BakePartials("{{>c}}{{>e}}", partials)
+	if expected := "d, e: partial not found"; !errors.Is(err, ErrPartialNotFound) || err.Error() != expected {
+		t.Errorf("expected %q got %v", expected, err)
+	}
+
+	fsys := fstest.MapFS{
+		"t/footer.mustache":       {Data: []byte("site footer")},
+		"t/pages/home.mustache":   {Data: []byte("{{>nav}}")},
+		"t/pages/nav.mustache":    {Data: []byte("{{>footer}}")},
+		"t/pages/footer.mustache": {Data: []byte("page footer")},
+	}
+	fp := &FileProvider{FS: fsys, Paths: []string{"t"}, Extensions: []string{".mustache"}, Relative: true}
+	sp, err = New().BakePartials("{{>pages/home}}", fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"pages/home": "{{>nav}}", "nav": "{{>footer}}", "footer": "page footer"}
+	if !reflect.DeepEqual(sp.Partials, expected) {
+		t.Errorf("expected %q got %q", expected, sp.Partials)
+	}
+	_, err = New().BakePartials("{{>footer}}{{>pages/home}}", fp)
+	if expected := "footer: included as both t/footer.mustache and t/pages/footer.mustache"; err == nil ||
+		err.Error() != expected {
+		t.Errorf("expected %q got %v", expected, err)
 	}
 }
 
-func TestJSONEscape(t *testing.T) {
+func TestPartialGraph(t *testing.T) {
+	sp := &StaticProvider{map[string]string{
+		"header": "{{>nav}}",
+		"body":   "{{#items}}{{>list}}{{/items}}{{^items}}{{>nav}}{{/items}}{{>ghost}}",
+		"nav":    "<nav></nav>",
+		"list":   "{{#children}}{{>item}}{{/children}}",
+		"item":   "{{name}}{{>list}}",
+	}}
+	tmpl, err := New().CompileString("{{>header}}{{>body}}{{>header}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := tmpl.PartialGraph(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"":       {"body", "header"},
+		"header": {"nav"},
+		"body":   {"ghost", "list", "nav"},
+		"nav":    nil,
+		"list":   {"item"},
+		"item":   {"list"},
+		"ghost":  nil,
+	}
+	if !reflect.DeepEqual(g.Includes, expected) {
+		t.Errorf("expected includes %v got %v", expected, g.Includes)
+	}
+	if cycles := [][]string{{"list", "item", "list"}}; !reflect.DeepEqual(g.Cycles, cycles) {
+		t.Errorf("expected cycles %v got %v", cycles, g.Cycles)
+	}
+	if deps := g.Dependents("nav"); !reflect.DeepEqual(deps, []string{"", "body", "header"}) {
+		t.Errorf("expected nav dependents [ body header] got %v", deps)
+	}
+	if deps := g.Dependents("item"); !reflect.DeepEqual(deps, []string{"", "body", "item", "list"}) {
+		t.Errorf("expected item dependents [ body item list] got %v", deps)
+	}
+
+	// A relative provider resolves the names in each partial from that partial, as when rendering.
+	fsys := fstest.MapFS{
+		"templates/pages/home.mustache":      {Data: []byte("{{>../partials/header}}")},
+		"templates/partials/header.mustache": {Data: []byte("{{>nav}}")},
+		"templates/partials/nav.mustache":    {Data: []byte("{{>links}}")},
+		"templates/partials/links.mustache":  {Data: []byte("<a></a>")},
+	}
+	fp := &FileProvider{FS: fsys, Paths: []string{"templates"}, Extensions: []string{".mustache"}, Relative: true}
+	tmpl, err = New().CompileFS(fsys, "templates/pages/home.mustache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = tmpl.PartialGraph(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string][]string{
+		"templates/pages/home.mustache": {"../partials/header"},
+		"../partials/header":            {"nav"},
+		"nav":                           {"links"},
+		"links":                         nil,
+	}
+	if !reflect.DeepEqual(g.Includes, expected) {
+		t.Errorf("expected includes %v got %v", expected, g.Includes)
+	}
+}
+
+func TestOptionalPartial(t *testing.T) {
+	sp := &StaticProvider{map[string]string{"header": "<h1>{{title}}</h1>"}}
+	context := map[string]string{"title": "Hi"}
 	tests := []struct {
-		Before string
-		After  string
+		tmpl     string
+		expected string
 	}{
-		{`'single quotes'`, `'single quotes'`},
-		{`"double quotes"`, `\"double quotes\"`},
-		{`\backslash\`, `\\backslash\\`},
-		{"some\tcontrol\ncharacters\x1c\b\f\r", `some\tcontrol\ncharacters\u001c\b\f\r`},
-		{`🦜`, `🦜`},
+		{`{{>?header}}`, "<h1>Hi</h1>"},
+		{`{{> ? header }}`, "<h1>Hi</h1>"},
+		{`[{{>?custom-header}}]`, "[]"},
+		{`{{>?custom-header}}{{>header}}`, "<h1>Hi</h1>"},
 	}
-	var buf bytes.Buffer
-	for _, tst := range tests {
-		if err := JSONEscape(&buf, tst.Before); err != nil {
-			t.Error(err)
-		}
-		txt := buf.String()
-		if txt != tst.After {
-			t.Errorf("got %s expected %s", txt, tst.After)
+	for _, strict := range []bool{false, true} {
+		for _, test := range tests {
+			tmpl, err := New().WithPartials(sp).WithErrors(strict).
+				WithMissingPartialPlaceholder(func(string) string { return "MISSING" }).CompileString(test.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := tmpl.Render(context)
+			if err != nil {
+				t.Errorf("%q with errors %v: %v", test.tmpl, strict, err)
+			} else if output != test.expected {
+				t.Errorf("%q with errors %v expected %q got %q", test.tmpl, strict, test.expected, output)
+			}
 		}
-		buf.Reset()
 	}
 }
 
-func TestRenderRaw(t *testing.T) {
+func TestPartialIndentTabWidth(t *testing.T) {
+	partials := &StaticProvider{map[string]string{
+		"item":   "a: 1\nb: 2\n",
+		"nested": "list:\n\t{{>item}}\n",
+		"tree":   "- {{name}}\n{{#children}}\n\t{{>@self}}\n{{/children}}\n",
+	}}
 	tests := []struct {
-		Template string
-		Data     map[string]interface{}
-		Result   string
+		width    int
+		template string
+		expected string
 	}{
-		{
-			Template: `{{a}} {{b}} {{c}}`,
-			Data:     map[string]interface{}{"a": `<a href="">`, "b": "}o&o{", "c": "\t"},
-			Result:   "<a href=\"\"> }o&o{ \t",
-		},
+		{0, "root:\n\t{{>item}}\n", "root:\n\ta: 1\n\tb: 2\n"},
+		{2, "root:\n\t{{>item}}\n", "root:\n  a: 1\n  b: 2\n"},
+		{4, "root:\n \t{{>item}}\n", "root:\n    a: 1\n    b: 2\n"},
+		{4, "root:\n    {{>item}}\n", "root:\n    a: 1\n    b: 2\n"},
+		{2, "root:\n\t{{>nested}}\n", "root:\n  list:\n    a: 1\n    b: 2\n"},
+		{2, "root:\n\t{{>&item}}\n", "root:\n  a: 1\n  b: 2\n"},
+		{2, "{{>tree}}", "- a\n  - b\n    - c\n"},
 	}
-	for _, tst := range tests {
-		tmpl, err := New().WithEscapeMode(Raw).CompileString(tst.Template)
+	data := map[string]interface{}{"name": "a", "children": []map[string]interface{}{
+		{"name": "b", "children": []map[string]interface{}{{"name": "c", "children": nil}}},
+	}}
+	for _, test := range tests {
+		tmpl, err := New().WithPartials(partials).WithPartialIndentTabWidth(test.width).CompileString(test.template)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		txt, err := tmpl.Render(tst.Data)
+		output, err := tmpl.Render(data)
 		if err != nil {
-			t.Error(err)
-		}
-		if txt != tst.Result {
-			t.Errorf("expected %s got %s", tst.Result, txt)
+			t.Errorf("%q: %v", test.template, err)
+		} else if output != test.expected {
+			t.Errorf("%q with width %d: expected %q got %q", test.template, test.width, test.expected, output)
 		}
 	}
 }
 
-func TestRenderJSON(t *testing.T) {
-	type item struct {
-		Emoji string
-		Name  string
+func TestPartialPreprocessor(t *testing.T) {
+	var names []string
+	partials := &StaticProvider{map[string]string{
+		"greeting": "hello, {{name}}\n",
+		"raw":      "{{name}}",
+		"bad":      "x",
+	}}
+	preprocess := func(name, source string) (string, error) {
+		names = append(names, name)
+		if name == "bad" {
+			return "", errors.New("bad partial")
+		}
+		// Tags are left as they are, so they still match the data.
+		return strings.ReplaceAll(strings.ToUpper(source), "{{NAME}}", "{{name}}"), nil
+	}
+	tmpl, err := New().WithPartials(partials).WithPartialPreprocessor(preprocess).
+		CompileString("{{>greeting}}  {{>greeting}}\n  {{>greeting}}\n{{>&raw}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"name": "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "HELLO, world\n  HELLO, world\n\n  HELLO, world\n{{name}}"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	if expected := []string{"greeting", "greeting", "greeting"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected the preprocessor to be called for %q, got %q", expected, names)
+	}
+
+	tmpl, err = New().WithPartials(partials).WithPartialPreprocessor(preprocess).CompileString("a{{>bad}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(nil); err == nil || err.Error() != "line 1: bad partial" {
+		t.Errorf("expected the preprocessor's error, got %v", err)
 	}
+}
 
+func TestPlanPartials(t *testing.T) {
+	partials := &StaticProvider{map[string]string{
+		"header": "{{>nav}}{{#user}}{{>account}}{{/user}}",
+		"nav":    "{{#items}}{{>item}}{{/items}}",
+		"item":   "{{>nav}}",
+		"admin":  "{{>audit}}",
+	}}
+	calls := 0
+	tmpl, err := New().WithPartials(partials).WithPartialHooks(func(string) error {
+		calls++
+		return errors.New("not allowed")
+	}, nil).CompileString("{{>header}}{{#admin}}{{>admin}}{{/admin}}{{>&footer}}{{>?missing}}{{>@self}}")
+	if err != nil {
+		t.Fatal(err)
+	}
 	tests := []struct {
-		Template string
-		Data     map[string]interface{}
-		Result   string
+		data     interface{}
+		expected []string
 	}{
-		{
-			Template: `{"a": "{{a}}", "b": "{{b}}", "c": "{{c}}"}`,
-			Data:     map[string]interface{}{"a": "Text\nwith\tcontrols", "b": `"I said 'No!'"`, "c": "EOF\u001cHERE"},
-			Result:   `{"a": "Text\nwith\tcontrols", "b": "\"I said 'No!'\"", "c": "EOF\u001cHERE"}`,
-		},
-		{
-			Template: `{"a": [""{{#a}},"{{.}}"{{/a}}]}`,
-			Data:     map[string]interface{}{"a": []int{1, 2, 3}},
-			Result:   `{"a": ["","1","2","3"]}`,
-		},
-		{
-			Template: `"{{#values}}{{Emoji}}{{Name}} {{/values}}"`,
-			Data: map[string]interface{}{
-				"values": interface{}([]item{
-					{
-						Emoji: "🟡",
-						Name:  "Rico",
-					},
-					{
-						Emoji: "🟢",
-						Name:  "Bruce",
-					},
-					{
-						Emoji: "🔵",
-						Name:  "Luna",
-					},
-				}),
-			},
-			Result: `"🟡Rico 🟢Bruce 🔵Luna "`,
-		},
+		{map[string]interface{}{}, []string{"footer", "header", "missing", "nav"}},
+		{map[string]interface{}{"user": "ann", "items": []int{1}, "admin": true},
+			[]string{"account", "admin", "audit", "footer", "header", "item", "missing", "nav"}},
 	}
-	for _, tst := range tests {
-		tmpl, err := New().WithEscapeMode(EscapeJSON).CompileString(tst.Template)
-		if err != nil {
-			t.Error(err)
-		}
-		tmpl.outputMode = EscapeJSON
-		txt, err := tmpl.Render(tst.Data)
+	for _, test := range tests {
+		plan, err := tmpl.PlanPartials(test.data)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if txt != tst.Result {
-			t.Errorf("expected %s got %s", tst.Result, txt)
+		if !reflect.DeepEqual(plan, test.expected) {
+			t.Errorf("%v: expected %q got %q", test.data, test.expected, plan)
 		}
 	}
+	if calls != 0 {
+		t.Errorf("expected the hooks not to be called, got %d calls", calls)
+	}
 }
 
-// Make sure bugs caught by fuzz testing don't creep back in
-func TestCrashers(t *testing.T) {
-	crashers := []string{
-		`{{#}}{{#}}{{#}}{{#}}{{#}}{{=}}`,
-		`{{#}}{{#}}{{#}}{{#}}{{#}}{{#}}{{#}}{{#}}{{=}}`,
-		`{{=}}`,
+func TestPartialHooks(t *testing.T) {
+	var calls []string
+	errDenied := errors.New("denied")
+	partials := &StaticProvider{map[string]string{
+		"outer":  "[{{>inner}}]",
+		"inner":  "<{{name}}>",
+		"secret": "hidden",
+	}}
+	before := func(name string) error {
+		calls = append(calls, "before "+name)
+		if name == "secret" {
+			return errDenied
+		}
+		return nil
 	}
-	for i, c := range crashers {
-		t.Log(i)
-		_, err := New().CompileString(c)
+	after := func(name string) error {
+		calls = append(calls, "after "+name)
+		return nil
+	}
+	tmpl, err := New().WithPartials(partials).WithPartialHooks(before, after).CompileString("{{>outer}}{{>inner}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[<x>]<x>"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	expected := []string{"before outer", "before inner", "after inner", "after outer", "before inner", "after inner"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %q got %q", expected, calls)
+	}
+
+	// An error from before stops the render, without rendering or fetching the partial.
+	calls = nil
+	tmpl, err = New().WithPartials(partials).WithPartialHooks(before, after).CompileString("a{{>secret}}b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = tmpl.Render(nil)
+	if !errors.Is(err, errDenied) {
+		t.Errorf("expected the error from before, got %v", err)
+	}
+	if output != "a" {
+		t.Errorf("expected the render to stop at the partial, got %q", output)
+	}
+	if expected := []string{"before secret"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %q got %q", expected, calls)
+	}
+
+	// An error from after stops the render too, and either hook may be nil.
+	tmpl, err = New().WithPartials(partials).WithPartialHooks(nil, func(string) error { return errDenied }).
+		CompileString("{{>inner}}b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(nil); !errors.Is(err, errDenied) {
+		t.Errorf("expected the error from after, got %v", err)
+	}
+}
+
+func TestSelfPartial(t *testing.T) {
+	type node struct {
+		Name     string
+		Children []node
+	}
+	tree := node{"a", []node{
+		{"b", []node{{"c", []node{{"d", nil}}}}},
+		{"e", nil},
+	}}
+	tmpl, err := New().CompileString("{{Name}}{{#Children}}({{>@self}}){{/Children}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a(b(c(d)))(e)"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+
+	// In a partial, @self is the partial, and a standalone tag indents it.
+	partials := &StaticProvider{Partials: map[string]string{"item": "- {{Name}}\n{{#Children}}\n  {{>@self}}\n{{/Children}}\n"}}
+	tmpl, err = New().WithPartials(partials).CompileString("<pre>\n{{>item}}\n</pre>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = tmpl.Render(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<pre>\n- a\n  - b\n    - c\n      - d\n  - e\n</pre>"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	graph, err := tmpl.PartialGraph(partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(graph.Includes, map[string][]string{"": {"item"}, "item": nil}) {
+		t.Errorf("expected @self to be left out of the partial graph, got %v", graph.Includes)
+	}
+
+	// Recursion without end is stopped, whether through @self or a named partial.
+	partials = &StaticProvider{Partials: map[string]string{"loop": "x{{>loop}}"}}
+	for _, src := range []string{"x{{>@self}}", "{{>loop}}"} {
+		tmpl, err = New().WithPartials(partials).CompileString(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err = tmpl.Render(nil)
+		if err == nil || !strings.Contains(err.Error(), "partials nested more than 100 deep") {
+			t.Errorf("%q: expected a nesting error, got %v", src, err)
+		}
+		if len(output) != 100 && len(output) != 101 {
+			t.Errorf("%q: expected the output to stop after 100 partials, got %d bytes", src, len(output))
+		}
+	}
+
+	if _, err := New().CompileString("{{>&@self}}"); err == nil {
+		t.Error("expected an error for a raw @self partial")
+	}
+}
+
+func TestRawPartial(t *testing.T) {
+	sp := &StrictStaticProvider{map[string]string{
+		"license": "Copyright {{notatag}} & co\nAll rights reserved\n",
+		"broken":  "{{unclosed",
+	}}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`<!-- {{>&license}} -->`, "<!-- Copyright {{notatag}} & co\nAll rights reserved\n -->"},
+		{"<pre>\n  {{> & license}}\n</pre>", "<pre>\n  Copyright {{notatag}} & co\n  All rights reserved\n</pre>"},
+		{`{{>&broken}}`, "{{unclosed"},
+		{`[{{>?&missing}}]`, "[]"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithPartials(sp).WithErrors(true).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(map[string]string{"notatag": "x"})
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithPartials(sp).WithErrors(true).CompileString(`{{>&missing}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(nil); !errors.Is(err, ErrPartialNotFound) {
+		t.Errorf("expected ErrPartialNotFound got %v", err)
+	}
+	if _, err := New().CompileString(`{{>&license user}}`); err == nil {
+		t.Error("expected an error for a raw partial with a context")
+	}
+
+	tmpl, err = New().CompileString(`{{>&broken}}{{>&license}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := tmpl.PartialGraph(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"": {"broken", "license"}, "broken": nil, "license": nil}
+	if !reflect.DeepEqual(g.Includes, expected) {
+		t.Errorf("expected includes %v got %v", expected, g.Includes)
+	}
+}
+
+func TestRenderPartial(t *testing.T) {
+	tmpl, err := New().WithErrors(true).CompileString("<h1>{{title}}</h1>\n{{#items}}<li>{{name}}</li>{{/items}}\n<p>{{footer}}</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := map[string]interface{}{
+		"title": "List",
+		"items": []map[string]string{{"name": "a"}, {"name": "b"}, {}},
+	}
+	output, err := tmpl.RenderPartial(context)
+	if expected := "<h1>List</h1>\n<li>a</li><li>b</li><li>"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	if err == nil || err.Error() != `line 2: missing variable "name"` {
+		t.Errorf("expected a missing variable error got %v", err)
+	}
+}
+
+func TestFrenderAtomic(t *testing.T) {
+	tmpl, err := New().WithErrors(true).CompileString("<h1>{{title}}</h1>\n<p>{{footer}}</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain, atomic bytes.Buffer
+	if err := tmpl.Frender(&plain, map[string]string{"title": "List"}); err == nil {
+		t.Error("expected an error")
+	}
+	if plain.Len() == 0 {
+		t.Error("expected Frender to have written the output before the error")
+	}
+	if err := tmpl.FrenderAtomic(&atomic, map[string]string{"title": "List"}); err == nil ||
+		err.Error() != `line 2: missing variable "footer"` {
+		t.Errorf("expected a missing variable error, got %v", err)
+	}
+	if atomic.Len() != 0 {
+		t.Errorf("expected FrenderAtomic to write nothing, got %q", atomic.String())
+	}
+
+	if err := tmpl.FrenderAtomic(&atomic, map[string]string{"title": "List", "footer": "end"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<h1>List</h1>\n<p>end</p>"; atomic.String() != expected {
+		t.Errorf("expected %q got %q", expected, atomic.String())
+	}
+}
+
+func TestTrimTrailingNewline(t *testing.T) {
+	fsys := fstest.MapFS{
+		"row.csv":   {Data: []byte("{{a}},{{b}}\n")},
+		"crlf.csv":  {Data: []byte("{{a}},{{b}}\r\n")},
+		"two.csv":   {Data: []byte("{{a}},{{b}}\n\n")},
+		"plain.csv": {Data: []byte("{{a}},{{b}}")},
+	}
+	context := map[string]int{"a": 1, "b": 2}
+	tests := []struct {
+		name     string
+		trim     bool
+		expected string
+	}{
+		{"row.csv", false, "1,2\n"},
+		{"row.csv", true, "1,2"},
+		{"crlf.csv", true, "1,2"},
+		{"two.csv", true, "1,2\n"},
+		{"plain.csv", true, "1,2"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithTrimTrailingNewline(test.trim).CompileFS(fsys, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%s expected %q got %q", test.name, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithTrimTrailingNewline(true).CompileString("{{a}}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, _ := tmpl.Render(context); output != "1\n" {
+		t.Errorf("expected a template compiled from a string to keep its newline, got %q", output)
+	}
+}
+
+func TestRenderErrorPath(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.mustache":   {Data: []byte("{{>layout}}")},
+		"layout.mustache": {Data: []byte("<html>\n{{#user}}\n{{>header}}\n{{/user}}\n</html>")},
+		"header.mustache": {Data: []byte("<header>\n<nav>\n</nav>\n<h1>{{title}}</h1>\n</header>")},
+	}
+	cmpl := New().WithErrors(true).WithPartials(&FileProvider{FS: fsys, Extensions: []string{".mustache"}})
+	tmpl, err := cmpl.CompileFS(fsys, "page.mustache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tmpl.Render(map[string]interface{}{"user": true})
+	expected := `page.mustache > layout > header: line 4: missing variable "title"`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q got %v", expected, err)
+	}
+	var re *RenderError
+	if !errors.As(err, &re) || re.Line != 4 || !reflect.DeepEqual(re.Path, []string{"page.mustache", "layout", "header"}) {
+		t.Errorf("expected a RenderError at line 4 of header got %#v", re)
+	}
+
+	// errors in the template itself and from the partial tag have no path, unless it was compiled from a file
+	tmpl, err = cmpl.CompileString("{{#a}}\n{{>nothere}}\n{{/a}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tmpl.Render(map[string]bool{"a": true})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2: ") || !errors.Is(err, ErrPartialNotFound) {
+		t.Errorf("expected a missing partial error at line 2 got %v", err)
+	}
+}
+
+func TestPartialSafety(t *testing.T) {
+	tmpl, err := New().WithErrors(true).WithPartials(&FileProvider{}).CompileString("{{>../unsafe}}")
+	if err != nil {
+		t.Error(err)
+	}
+	txt, err := tmpl.Render(nil)
+	if err == nil {
+		t.Errorf("expected error for unsafe partial")
+	}
+	if txt != "" {
+		t.Errorf("expected unsafe partial to fail")
+	}
+}
+
+func TestPartialSafetyWindows(t *testing.T) {
+	tmpl, err := New().WithErrors(true).WithPartials(&FileProvider{}).CompileString("{{>spec/..\\..\\test.txt}}")
+	if err != nil {
+		t.Error(err)
+	}
+	txt, err := tmpl.Render(nil)
+	if err == nil {
+		t.Errorf("expected error for unsafe partial")
+	}
+	if txt != "" {
+		t.Errorf("expected unsafe partial to fail")
+	}
+}
+
+func TestPartialFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"partials/header.mustache": {Data: []byte("<h1>{{title}}</h1>")},
+		"secret.mustache":          {Data: []byte("secret")},
+	}
+	fp := &FileProvider{FS: fsys, Paths: []string{"partials"}, Extensions: []string{".mustache"}}
+	tmpl, err := New().WithErrors(true).WithPartials(fp).CompileString("{{>header}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"title": "Hi"})
+	if err != nil {
+		t.Error(err)
+	} else if output != "<h1>Hi</h1>" {
+		t.Errorf("expected %q got %q", "<h1>Hi</h1>", output)
+	}
+
+	for _, name := range []string{"../secret", "..\\secret", "partials/../../secret"} {
+		if _, err := fp.Get(name); err == nil || errors.Is(err, ErrPartialNotFound) {
+			t.Errorf("%s: expected unsafe partial error, got %v", name, err)
+		}
+	}
+	if _, err := fp.Get("missing"); !errors.Is(err, ErrPartialNotFound) {
+		t.Errorf("expected ErrPartialNotFound, got %v", err)
+	}
+}
+
+func TestPartialNotFoundPaths(t *testing.T) {
+	fsys := fstest.MapFS{"partials/other.mustache": {Data: []byte("other")}}
+	fp := &FileProvider{FS: fsys, Paths: []string{"partials", "shared"}}
+	_, err := fp.Get("header")
+	if !errors.Is(err, ErrPartialNotFound) {
+		t.Errorf("expected ErrPartialNotFound, got %v", err)
+	}
+	expected := "header: partial not found (tried: partials/header, partials/header.mustache, partials/header.stache, " +
+		"shared/header, shared/header.mustache, shared/header.stache)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q got %v", expected, err)
+	}
+
+	dir := t.TempDir()
+	fp = &FileProvider{Paths: []string{dir}, Extensions: []string{".mustache"}}
+	_, err = fp.Get("header")
+	expected = "header: partial not found (tried: " + filepath.Join(dir, "header.mustache") + ")"
+	if !errors.Is(err, ErrPartialNotFound) || err.Error() != expected {
+		t.Errorf("expected %q got %v", expected, err)
+	}
+}
+
+type failingProvider struct{}
+
+func (fp *failingProvider) Get(name string) (string, error) {
+	return "", fmt.Errorf("%s: disk on fire", name)
+}
+
+func TestRelativePartials(t *testing.T) {
+	fsys := fstest.MapFS{
+		"templates/pages/home.mustache":      {Data: []byte("{{>../partials/header}}<p>{{body}}</p>")},
+		"templates/pages/escape.mustache":    {Data: []byte("{{>../../secret}}")},
+		"templates/partials/header.mustache": {Data: []byte("<h1>{{title}}</h1>{{>nav}}")},
+		"templates/partials/nav.mustache":    {Data: []byte("<nav></nav>")},
+		"secret.mustache":                    {Data: []byte("secret")},
+	}
+	fp := &FileProvider{FS: fsys, Paths: []string{"templates"}, Extensions: []string{".mustache"}, Relative: true}
+	context := map[string]string{"title": "Hi", "body": "Welcome"}
+
+	tmpl, err := New().WithErrors(true).WithPartials(fp).CompileFS(fsys, "templates/pages/home.mustache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(context)
+	expected := "<h1>Hi</h1><nav></nav><p>Welcome</p>"
+	if err != nil {
+		t.Error(err)
+	} else if output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+
+	tmpl, err = New().WithErrors(true).WithPartials(fp).CompileFS(fsys, "templates/pages/escape.mustache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(context); err == nil || errors.Is(err, ErrPartialNotFound) {
+		t.Errorf("expected unsafe partial error, got %v", err)
+	}
+
+	// Templates without a file name fall back to searching the paths.
+	tmpl, err = New().WithErrors(true).WithPartials(fp).CompileString("{{>partials/header}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = tmpl.Render(context)
+	expected = "<h1>Hi</h1><nav></nav>"
+	if err != nil {
+		t.Error(err)
+	} else if output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	fsys := fstest.MapFS{
+		"emails/welcome.mustache":  {Data: []byte("{{>header}}Welcome, {{name}}!")},
+		"emails/goodbye.mustache":  {Data: []byte("{{>header}}Goodbye, {{name}}.")},
+		"emails/header.mustache":   {Data: []byte("Dear {{name}},\n")},
+		"emails/notes.txt":         {Data: []byte("{{#unclosed}}")},
+		"emails/drafts/x.mustache": {Data: []byte("draft")},
+	}
+	set, err := New().LoadDir(fsys, "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(set.Names(), ","); names != "goodbye,header,welcome" {
+		t.Errorf("expected templates goodbye,header,welcome got %s", names)
+	}
+	output, err := set.Render("welcome", map[string]string{"name": "Bob"})
+	expected := "Dear Bob,\nWelcome, Bob!"
+	if err != nil {
+		t.Error(err)
+	} else if output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	if set.Lookup("goodbye") == nil {
+		t.Error("expected to find goodbye template")
+	}
+	if _, err := set.Render("missing"); err == nil {
+		t.Error("expected error rendering missing template")
+	}
+
+	fsys["emails/broken.mustache"] = &fstest.MapFile{Data: []byte("{{#a}}")}
+	fsys["emails/worse.mustache"] = &fstest.MapFile{Data: []byte("{{/b}}")}
+	_, err = New().LoadDir(fsys, "emails")
+	if err == nil || !strings.Contains(err.Error(), "emails/broken.mustache") ||
+		!strings.Contains(err.Error(), "emails/worse.mustache") {
+		t.Errorf("expected errors for both broken templates, got %v", err)
+	}
+}
+
+func TestTemplateMetadata(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/blog/post.mustache": {Data: []byte(`{{@template.name}} {{@template.dir}}/style.css {{@template.path}} {{title}}`)},
+	}
+	tmpl, err := New().CompileFS(fsys, "site/blog/post.mustache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"title": "Hi"})
+	expected := "post.mustache site/blog/style.css site/blog/post.mustache Hi"
+	if err != nil {
+		t.Error(err)
+	} else if output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+
+	// data can override the metadata, and templates not compiled from files have none
+	output, err = tmpl.Render(map[string]interface{}{"@template": map[string]string{"name": "x", "dir": "d"}})
+	if expected := "x d/style.css  "; err != nil || output != expected {
+		t.Errorf("expected %q got %q (%v)", expected, output, err)
+	}
+	tmpl, err = New().CompileString(`[{{@template.name}}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = tmpl.Render(nil)
+	if err != nil || output != "[]" {
+		t.Errorf("expected %q got %q (%v)", "[]", output, err)
+	}
+}
+
+func TestMissingPartialPlaceholder(t *testing.T) {
+	placeholder := func(name string) string {
+		return "[missing partial: " + name + "]"
+	}
+	tests := []struct {
+		provider PartialProvider
+		expected string
+		err      bool
+	}{
+		{&FileProvider{Paths: []string{"tests"}, Extensions: []string{".mustache"}}, "a [missing partial: header] b", false},
+		{&StrictStaticProvider{map[string]string{"footer": "c"}}, "a [missing partial: header] b", false},
+		// a StaticProvider gives an empty partial for a name it doesn't have, which isn't missing
+		{&StaticProvider{map[string]string{"footer": "c"}}, "a  b", false},
+		{&failingProvider{}, "a ", true},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithErrors(true).WithPartials(test.provider).
+			WithMissingPartialPlaceholder(placeholder).CompileString("a {{>header}} b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(nil)
+		if test.err && err == nil {
+			t.Errorf("expected error from %T", test.provider)
+		} else if !test.err && err != nil {
+			t.Error(err)
+		}
+		if output != test.expected {
+			t.Errorf("expected %q got %q", test.expected, output)
+		}
+	}
+
+	// Without errors enabled, missing partials still render as empty strings.
+	tmpl, err := New().WithPartials(&StrictStaticProvider{}).WithMissingPartialPlaceholder(placeholder).
+		CompileString("a {{>header}} b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(nil)
+	if err != nil {
+		t.Error(err)
+	} else if output != "a  b" {
+		t.Errorf("expected %q got %q", "a  b", output)
+	}
+}
+
+func TestPartialNotFound(t *testing.T) {
+	providers := []PartialProvider{
+		&FileProvider{Paths: []string{"tests"}},
+		&StrictStaticProvider{},
+	}
+	for _, pp := range providers {
+		_, err := pp.Get("missing")
+		if !errors.Is(err, ErrPartialNotFound) {
+			t.Errorf("%T: expected ErrPartialNotFound, got %v", pp, err)
+		}
+	}
+
+	sp := &StaticProvider{map[string]string{"a": "A"}}
+	if data, err := sp.Get("missing"); data != "" || err != nil {
+		t.Errorf("StaticProvider: expected an empty partial, got %q, %v", data, err)
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	context := map[string]interface{}{"users": makeVector(2), "text": "a\r\nb"}
+	tests := []struct {
+		mode     LineEndingMode
+		tmpl     string
+		expected string
+	}{
+		{Preserve, "{{#users}}\r\n{{Name}}\r\n{{/users}}", "Mike\r\nMike\r\n"},
+		{LF, "{{#users}}\r\n{{Name}}\r\n{{/users}}", "Mike\nMike\n"},
+		{LF, "one\r\ntwo\nthree\r\n", "one\ntwo\nthree\n"},
+		{CRLF, "one\r\ntwo\nthree\n", "one\r\ntwo\r\nthree\r\n"},
+		{CRLF, "{{#users}}\n{{Name}}\n{{/users}}", "Mike\r\nMike\r\n"},
+		// interpolated values are left alone
+		{LF, "{{text}}\r\n", "a\r\nb\n"},
+		{CRLF, "{{text}}\n", "a\r\nb\r\n"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithLineEndings(test.mode).CompileString(test.tmpl)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestJSONEscape(t *testing.T) {
+	tests := []struct {
+		Before string
+		After  string
+	}{
+		{`'single quotes'`, `'single quotes'`},
+		{`"double quotes"`, `\"double quotes\"`},
+		{`\backslash\`, `\\backslash\\`},
+		{"some\tcontrol\ncharacters\x1c\b\f\r", `some\tcontrol\ncharacters\u001c\b\f\r`},
+		{`🦜`, `🦜`},
+		{"bad\xff\xfebytes", "bad\ufffd\ufffdbytes"},
+		{"\xe2\x82 truncated", "\ufffd\ufffd truncated"},
+	}
+	var buf bytes.Buffer
+	for _, tst := range tests {
+		if err := JSONEscape(&buf, tst.Before); err != nil {
+			t.Error(err)
+		}
+		txt := buf.String()
+		if txt != tst.After {
+			t.Errorf("got %s expected %s", txt, tst.After)
+		}
+		buf.Reset()
+	}
+
+	tmpl, err := New().WithEscapeMode(EscapeJSON).CompileString(`{"value": "{{value}}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"value": "a\xff\xfeb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if !json.Valid([]byte(output)) || !utf8.ValidString(output) {
+		t.Errorf("expected valid JSON got %q", output)
+	} else if err := json.Unmarshal([]byte(output), &got); err != nil || got["value"] != "a\ufffd\ufffdb" {
+		t.Errorf("expected value %q got %q (%v)", "a\ufffd\ufffdb", got["value"], err)
+	}
+}
+
+func TestRenderRaw(t *testing.T) {
+	tests := []struct {
+		Template string
+		Data     map[string]interface{}
+		Result   string
+	}{
+		{
+			Template: `{{a}} {{b}} {{c}}`,
+			Data:     map[string]interface{}{"a": `<a href="">`, "b": "}o&o{", "c": "\t"},
+			Result:   "<a href=\"\"> }o&o{ \t",
+		},
+	}
+	for _, tst := range tests {
+		tmpl, err := New().WithEscapeMode(Raw).CompileString(tst.Template)
+		if err != nil {
+			t.Error(err)
+		}
+		txt, err := tmpl.Render(tst.Data)
+		if err != nil {
+			t.Error(err)
+		}
+		if txt != tst.Result {
+			t.Errorf("expected %s got %s", tst.Result, txt)
+		}
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	type item struct {
+		Emoji string
+		Name  string
+	}
+
+	tests := []struct {
+		Template string
+		Data     map[string]interface{}
+		Result   string
+	}{
+		{
+			Template: `{"a": "{{a}}", "b": "{{b}}", "c": "{{c}}"}`,
+			Data:     map[string]interface{}{"a": "Text\nwith\tcontrols", "b": `"I said 'No!'"`, "c": "EOF\u001cHERE"},
+			Result:   `{"a": "Text\nwith\tcontrols", "b": "\"I said 'No!'\"", "c": "EOF\u001cHERE"}`,
+		},
+		{
+			Template: `{"a": [""{{#a}},"{{.}}"{{/a}}]}`,
+			Data:     map[string]interface{}{"a": []int{1, 2, 3}},
+			Result:   `{"a": ["","1","2","3"]}`,
+		},
+		{
+			Template: `"{{#values}}{{Emoji}}{{Name}} {{/values}}"`,
+			Data: map[string]interface{}{
+				"values": interface{}([]item{
+					{
+						Emoji: "🟡",
+						Name:  "Rico",
+					},
+					{
+						Emoji: "🟢",
+						Name:  "Bruce",
+					},
+					{
+						Emoji: "🔵",
+						Name:  "Luna",
+					},
+				}),
+			},
+			Result: `"🟡Rico 🟢Bruce 🔵Luna "`,
+		},
+	}
+	for _, tst := range tests {
+		tmpl, err := New().WithEscapeMode(EscapeJSON).CompileString(tst.Template)
+		if err != nil {
+			t.Error(err)
+		}
+		txt, err := tmpl.Render(tst.Data)
+		if err != nil {
+			t.Error(err)
+		}
+		if txt != tst.Result {
+			t.Errorf("expected %s got %s", tst.Result, txt)
+		}
+	}
+}
+
+type jsonID int
+
+func (id jsonID) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"id-%d"`, id)), nil
+}
+
+type jsonPoint struct {
+	X, Y int
+}
+
+func (p jsonPoint) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`[%d,%d]`, p.X, p.Y)), nil
+}
+
+type textLevel int
+
+func (l textLevel) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("level \"%d\"", l)), nil
+}
+
+func TestRenderJSONMarshalers(t *testing.T) {
+	tmpl, err := New().WithEscapeMode(EscapeJSON).CompileString(`{"id": "{{id}}", "point": {{point}}, "level": "{{level}}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]interface{}{"id": jsonID(7), "point": &jsonPoint{1, 2}, "level": textLevel(3)}
+	output, err := tmpl.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"id": "id-7", "point": [1,2], "level": "level \"3\""}`
+	if output != expected {
+		t.Errorf("expected %s got %s", expected, output)
+	}
+
+	// Other escape modes are unaffected.
+	tmpl, err = New().WithEscapeMode(Raw).CompileString(`{{id}} {{level}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = tmpl.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "7 3" {
+		t.Errorf("expected %q got %q", "7 3", output)
+	}
+}
+
+func TestSetEscapeMode(t *testing.T) {
+	partials := &StaticProvider{Partials: map[string]string{"p": "{{a}}"}}
+	tmpl, err := New().WithPartials(partials).CompileString("{{a}} {{>p}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]string{"a": "<b>"}
+	tests := []struct {
+		tmpl     *Template
+		expected string
+	}{
+		{tmpl, "&lt;b&gt; &lt;b&gt;"},
+		{tmpl.SetEscapeMode(Raw), "<b> <b>"},
+		{tmpl.SetEscapeMode(Raw).SetEscapeMode(EscapeHTML), "&lt;b&gt; &lt;b&gt;"},
+	}
+	for i, test := range tests {
+		output, err := test.tmpl.Render(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%d: expected %q got %q", i, test.expected, output)
+		}
+	}
+}
+
+func TestByteSlices(t *testing.T) {
+	data := map[string]interface{}{"data": []byte("<hello>"), "none": []byte(nil)}
+	tests := []struct {
+		mode     EscapeMode
+		template string
+		expected string
+	}{
+		{EscapeHTML, "{{data}} {{{data}}}", "&lt;hello&gt; <hello>"},
+		{Raw, "{{data}}", "<hello>"},
+		{EscapeJSON, `{"data": "{{data}}"}`, `{"data": "PGhlbGxvPg=="}`},
+		{EscapeHTML, "{{#data}}[{{.}}]{{/data}}", "[&lt;hello&gt;]"},
+		{EscapeHTML, "{{none}}{{#none}}yes{{/none}}{{^none}}no{{/none}}", "no"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithEscapeMode(test.mode).CompileString(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.template, test.expected, output)
+		}
+	}
+
+	// The JSON encoding matches encoding/json.
+	b, _ := json.Marshal([]byte("<hello>"))
+	if string(b) != `"PGhlbGxvPg=="` {
+		t.Errorf("unexpected encoding/json output %s", b)
+	}
+}
+
+func TestEscapeSet(t *testing.T) {
+	tmpl, err := New().WithEscapeSet(map[rune]string{'|': `\|`, '\n': `\n`}).
+		CompileString("row {{a}} {{{a}}} {{b}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"a": "x|y\nz", "b": `<&'">`})
+	expected := "row x\\|y\\nz x|y\nz <&'\">"
+	if err != nil {
+		t.Error(err)
+	} else if output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+}
+
+func TestSafeString(t *testing.T) {
+	safe := SafeString("<b>bold</b>")
+	data := map[string]interface{}{
+		"plain":   "<b>bold</b>",
+		"safe":    safe,
+		"ptr":     &safe,
+		"html":    template.HTML("<i>it</i>"),
+		"list":    []SafeString{"<br>", "<hr>"},
+		"strings": []string{"<br>"},
+		"quoted":  SafeString(`<a href="x">`),
+	}
+	tests := []struct {
+		mode     EscapeMode
+		template string
+		expected string
+	}{
+		{EscapeHTML, "{{plain}} {{safe}} {{{safe}}} {{ptr}} {{html}}",
+			"&lt;b&gt;bold&lt;/b&gt; <b>bold</b> <b>bold</b> <b>bold</b> <i>it</i>"},
+		{EscapeHTML, "{{#list}}{{.}}{{/list}}{{#strings}}{{.}}{{/strings}}", "<br><hr>&lt;br&gt;"},
+		{EscapeJSON, `"{{quoted}}"`, `"<a href=\"x\">"`},
+		{EscapeHTMLAttr, `"{{html}}"`, `"&lt;i&gt;it&lt;/i&gt;"`},
+		{Raw, "{{plain}} {{safe}}", "<b>bold</b> <b>bold</b>"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithEscapeMode(test.mode).CompileString(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.template, test.expected, output)
+		}
+	}
+}
+
+func TestEscapeHTMLAttr(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{`" onclick="alert(1)`, `<a title="&#34; onclick=&#34;alert(1)" alt='&#34; onclick=&#34;alert(1)'>`},
+		{`' onclick='alert(1)`, `<a title="&#39; onclick=&#39;alert(1)" alt='&#39; onclick=&#39;alert(1)'>`},
+		{`<b> & "q" 'a'`, `<a title="&lt;b&gt; &amp; &#34;q&#34; &#39;a&#39;" alt='&lt;b&gt; &amp; &#34;q&#34; &#39;a&#39;'>`},
+		{"plain text", `<a title="plain text" alt='plain text'>`},
+	}
+	for _, test := range tests {
+		// The quotes are escaped even when the HTML escaping is limited.
+		tmpl, err := New().WithEscapeMode(EscapeHTMLAttr).WithHTMLEscapeChars("<>").
+			CompileString(`<a title="{{v}}" alt='{{v}}'>`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(map[string]string{"v": test.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.value, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithEscapeMode(EscapeHTMLAttr).CompileString(`{{{v}}} {{&v}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, err := tmpl.Render(map[string]string{"v": `"'`}); err != nil || output != `"' "'` {
+		t.Errorf("expected raw tags to be unescaped, got %q (%v)", output, err)
+	}
+}
+
+func TestHTMLEscapeChars(t *testing.T) {
+	tests := []struct {
+		chars    string
+		expected string
+	}{
+		{"<>", `&lt;b&gt; & "q" 'a' &lt;b&gt; & "q" 'a'`},
+		{"&", `<b> &amp; "q" 'a' <b> &amp; "q" 'a'`},
+		{"", `<b> & "q" 'a' <b> & "q" 'a'`},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithHTMLEscapeChars(test.chars).
+			WithPartials(&StaticProvider{map[string]string{"p": "{{a}}"}}).CompileString(`{{a}} {{>p}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(map[string]string{"a": `<b> & "q" 'a'`})
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.chars, test.expected, output)
+		}
+	}
+	tmpl, err := New().WithHTMLEscapeChars("é").CompileString(`{{a}} {{{a}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"a": "café"})
+	if expected := "caf&#233; café"; err != nil || output != expected {
+		t.Errorf("expected %q got %q (%v)", expected, output, err)
+	}
+}
+
+func TestBOM(t *testing.T) {
+	data := "\xEF\xBB\xBF{{name}}"
+	tmpl, err := New().CompileString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"name": "x"})
+	if err != nil {
+		t.Error(err)
+	} else if output != "x" {
+		t.Errorf("expected %q got %q", "x", output)
+	}
+
+	tmpl, err = New().WithPreserveBOM(true).CompileString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = tmpl.Render(map[string]string{"name": "x"})
+	if err != nil {
+		t.Error(err)
+	} else if expected := "\uFEFFx"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	data := "caf\xc3\xa9\n{{name}} \xe9t\xe9"
+	if _, err := New().CompileString(data); err != nil {
+		t.Errorf("expected invalid UTF-8 to be accepted by default, got %v", err)
+	}
+	_, err := New().WithValidateUTF8(true).CompileString(data)
+	if err == nil || err.Error() != "line 2: invalid UTF-8 at byte offset 15" {
+		t.Errorf("expected an error at offset 15 got %v", err)
+	}
+	if _, err := New().WithValidateUTF8(true).CompileString("\xEF\xBB\xBFcaf\u00e9 \ufffd {{name}}"); err != nil {
+		t.Errorf("expected valid UTF-8 to compile, got %v", err)
+	}
+}
+
+func TestEscapeFunc(t *testing.T) {
+	upper := func(w io.Writer, s string) error {
+		_, err := io.WriteString(w, strings.ToUpper(s))
+		return err
+	}
+	tmpl, err := New().WithEscapeFunc(upper).CompileString(`{{a}} {{{a}}} {{&a}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"a": "<b>"})
+	if err != nil {
+		t.Error(err)
+	} else if expected := "<B> <b> <b>"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+
+	// pass html_body through raw, and HTML escape everything else, whatever the tag
+	policy := func(w io.Writer, name string, raw bool, s string) error {
+		if name == "html_body" {
+			_, err := io.WriteString(w, s)
+			return err
+		}
+		_, err := io.WriteString(w, template.HTMLEscapeString(s))
+		return err
+	}
+	tmpl, err = New().WithEscapeFunc(upper).WithTagEscapeFunc(policy).
+		CompileString(`{{html_body}} {{title}} {{{title}}} {{&html_body}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = tmpl.Render(map[string]string{"html_body": "<p>hi</p>", "title": "<script>"})
+	if err != nil {
+		t.Error(err)
+	} else if expected := "<p>hi</p> &lt;script&gt; &lt;script&gt; <p>hi</p>"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+
+	failing := func(w io.Writer, name string, raw bool, s string) error {
+		return fmt.Errorf("cannot escape %s", name)
+	}
+	tmpl, err = New().WithTagEscapeFunc(failing).CompileString(`a{{b}}c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tmpl.Render(map[string]string{"b": "b"}); err == nil || err.Error() != "line 1: cannot escape b" {
+		t.Errorf("expected error from escape func, got %v", err)
+	}
+}
+
+func TestPassthroughMissing(t *testing.T) {
+	context := map[string]interface{}{
+		"name":  "Bob",
+		"items": []string{"a", "b"},
+		"user":  map[string]string{"id": "1"},
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`Hello {{name}}, {{ later }}`, `Hello Bob, {{ later }}`},
+		{`{{{raw}}} {{&amp}} {{name}}`, `{{{raw}}} {{&amp}} Bob`},
+		{`{{user.id}} {{user.name}}`, `1 {{user.name}}`},
+		{`{{#items}}[{{.}}{{later}}]{{/items}}`, `[a{{later}}][b{{later}}]`},
+		{`{{#later}}{{name}} {{#items}}x{{/items}}{{/later}}!`, `{{#later}}{{name}} {{#items}}x{{/items}}{{/later}}!`},
+		{`{{^later}}no{{/later}}{{^name}}no{{/name}}`, `{{^later}}no{{/later}}`},
+		{`{{#each later}}{{@index}}{{/each}}`, `{{#each later}}{{@index}}{{/each}}`},
+		{"{{#later}}\nline\n{{/later}}\n{{name}}", "{{#later}}\nline\n{{/later}}\nBob"},
+		{`{{=<% %>=}}<%name%> <%later%>`, `Bob <%later%>`},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithPassthroughMissing(true).WithErrors(true).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestSQLNull(t *testing.T) {
+	context := map[string]interface{}{
+		"name":     sql.NullString{String: "Bob", Valid: true},
+		"noName":   sql.NullString{String: "ignored"},
+		"age":      &sql.NullInt64{Int64: 42, Valid: true},
+		"noAge":    sql.NullInt64{Int64: 7},
+		"empty":    sql.NullString{Valid: true},
+		"nullable": sql.NullBool{Bool: true, Valid: true},
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{name}} {{age}} {{nullable}}`, "Bob 42 true"},
+		{`[{{noName}}] [{{noAge}}] [{{empty}}]`, "[] [] []"},
+		{`{{#name}}Hi {{.}}{{/name}}{{^noName}} anonymous{{/noName}}`, "Hi Bob anonymous"},
+		{`{{#age}}{{.}}{{/age}}{{#noAge}}set{{/noAge}}{{^noAge}}unset{{/noAge}}`, "42unset"},
+		{`{{#empty}}set{{/empty}}{{^empty}}empty{{/empty}}`, "empty"},
+		{`{{name.Valid}} {{noName.Valid}}`, "true false"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestSanitizer(t *testing.T) {
+	script := regexp.MustCompile(`(?s)<script.*?</script>`)
+	sanitize := func(s string) string {
+		return script.ReplaceAllString(s, "")
+	}
+	context := map[string]string{"body": `<b>Hi</b><script>alert(1)</script>`}
+	tests := []struct {
+		tmpl      string
+		sanitizer func(string) string
+		expected  string
+	}{
+		{`{{safe body}}`, sanitize, `<b>Hi</b>`},
+		{`{{ safe  body }}`, sanitize, `<b>Hi</b>`},
+		{`{{body}}`, sanitize, `&lt;b&gt;Hi&lt;/b&gt;&lt;script&gt;alert(1)&lt;/script&gt;`},
+		{`{{{body}}}`, sanitize, `<b>Hi</b><script>alert(1)</script>`},
+		{`{{safe body}}`, nil, `&lt;b&gt;Hi&lt;/b&gt;&lt;script&gt;alert(1)&lt;/script&gt;`},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithSanitizer(test.sanitizer).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestJSONHelper(t *testing.T) {
+	context := map[string]interface{}{
+		"name": "<b>",
+		"user": map[string]interface{}{"id": 7, "tags": []string{"a", "b"}},
+	}
+	for _, mode := range []EscapeMode{EscapeHTML, EscapeJSON, Raw} {
+		tmpl, err := New().WithEscapeMode(mode).CompileString(`{{json .}}|{{json user}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.SplitN(output, "|", 2)
+		whole, user := parts[0], parts[len(parts)-1]
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(whole), &got); err != nil {
+			t.Errorf("mode %d: invalid JSON %q: %v", mode, whole, err)
+		} else if got["name"] != "<b>" {
+			t.Errorf("mode %d: expected name <b> got %v", mode, got["name"])
+		}
+		if expected := "{\n  \"id\": 7,\n  \"tags\": [\n    \"a\",\n    \"b\"\n  ]\n}"; user != expected {
+			t.Errorf("mode %d: expected %q got %q", mode, expected, user)
+		}
+	}
+}
+
+func TestPluralAndOrdinal(t *testing.T) {
+	tests := []struct {
+		count   interface{}
+		plural  string
+		ordinal string
+	}{
+		{0, "0 messages", "0th"},
+		{1, "1 message", "1st"},
+		{2, "2 messages", "2nd"},
+		{3, "3 messages", "3rd"},
+		{11, "11 messages", "11th"},
+		{12, "12 messages", "12th"},
+		{13, "13 messages", "13th"},
+		{21, "21 messages", "21st"},
+		{111, "111 messages", "111th"},
+		{uint8(1), "1 message", "1st"},
+		{1.0, "1 message", "1st"},
+		{"22", "22 messages", "22nd"},
+		{-1, "-1 messages", "-1st"},
+	}
+	tmpl, err := New().CompileString(`{{count}} {{plural count "message" "messages"}}|{{ordinal count}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		output, err := tmpl.Render(map[string]interface{}{"count": test.count})
+		expected := test.plural + "|" + test.ordinal
+		if err != nil {
+			t.Error(err)
+		} else if output != expected {
+			t.Errorf("%#v expected %q got %q", test.count, expected, output)
+		}
+	}
+
+	for _, count := range []interface{}{"many", 1.5, []int{1}} {
+		if _, err := tmpl.Render(map[string]interface{}{"count": count}); err == nil {
+			t.Errorf("%#v: expected error", count)
+		}
+	}
+
+	// A rule with three forms, as in Polish: 1 plik, 2-4 pliki, 5 plików.
+	polish := func(n float64) int {
+		i := int64(n)
+		switch {
+		case i == 1:
+			return 0
+		case i%10 >= 2 && i%10 <= 4 && (i%100 < 12 || i%100 > 14):
+			return 1
+		default:
+			return 2
+		}
+	}
+	tmpl, err = New().WithPluralRule(polish).CompileString(`{{plural n "plik" "pliki" "plików"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, expected := range map[int]string{1: "plik", 3: "pliki", 5: "plików", 12: "plików", 22: "pliki"} {
+		output, err := tmpl.Render(map[string]int{"n": n})
+		if err != nil {
+			t.Error(err)
+		} else if output != expected {
+			t.Errorf("%d expected %q got %q", n, expected, output)
+		}
+	}
+
+	for _, bad := range []string{`{{plural n}}`, `{{ordinal n "th"}}`, `{{plural "n" "a"}}`, `{{plural n "a}}`, `{{plural n "a"b}}`} {
+		if _, err := New().CompileString(bad); err == nil {
+			t.Errorf("%s: expected parse error", bad)
+		}
+	}
+}
+
+func TestDisallowRaw(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		err  string
+	}{
+		{`{{x}}`, ""},
+		{`{{{x}}}`, "line 1: raw tag not allowed: {{{x}}}"},
+		{"a\n{{& x }}", "line 2: raw tag not allowed: {{& x }}"},
+		{`{{#a}}{{=<% %>=}}<%{x}%><%/a%>`, "line 1: raw tag not allowed: <%{x}%>"},
+	}
+	for _, test := range tests {
+		_, err := New().WithDisallowRaw(true).CompileString(test.tmpl)
+		if test.err == "" && err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%q expected error %q got %v", test.tmpl, test.err, err)
+		}
+		if _, err := New().CompileString(test.tmpl); err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		}
+	}
+}
+
+type onOff bool
+
+func (b onOff) String() string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func TestBoolFormat(t *testing.T) {
+	context := map[string]interface{}{
+		"settings": Settings{Allow: true},
+		"deny":     false,
+		"light":    onOff(true),
+	}
+	tmpl := `{{settings.Allow}} {{deny}} {{light}}`
+	tests := []struct {
+		compiler *Compiler
+		expected string
+	}{
+		{New(), "true false on"},
+		{New().WithBoolFormat("1", "0"), "1 0 on"},
+		{New().WithBoolFormat("yes", "no").WithEscapeMode(EscapeJSON), "yes no on"},
+	}
+	for _, test := range tests {
+		tmpl, err := test.compiler.CompileString(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("expected %q got %q", test.expected, output)
+		}
+	}
+}
+
+type rowError struct {
+	Row    int
+	Reason string
+}
+
+func (e *rowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Reason)
+}
+
+func TestErrorValues(t *testing.T) {
+	type result struct {
+		Err     error
+		Warning rowError
+	}
+	tests := []struct {
+		tmpl     string
+		context  interface{}
+		expected string
+	}{
+		{`{{err}}`, map[string]interface{}{"err": &rowError{3, "bad date"}}, "row 3: bad date"},
+		{`{{err}}`, map[string]error{"err": errors.New("failed")}, "failed"},
+		{`[{{err}}]{{#err}}failed{{/err}}{{^err}}ok{{/err}}`, map[string]error{"err": nil}, "[]ok"},
+		{`[{{Err}}]{{^Err}}ok{{/Err}}`, result{}, "[]ok"},
+		{`{{Warning}}`, &result{Warning: rowError{4, "too long"}}, "row 4: too long"},
+		{`{{#Err}}{{.}}{{/Err}}`, result{Err: &rowError{5, "missing"}}, "row 5: missing"},
+		{`[{{a}}{{{a}}}{{&a}}]`, map[string]interface{}{"a": nil}, "[]"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(test.context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+type point struct {
+	X, Y int
+}
+
+func (p point) String() string {
+	return fmt.Sprintf("(%d, %d)", p.X, p.Y)
+}
+
+func TestStrictTypes(t *testing.T) {
+	context := map[string]interface{}{
+		"user":   User{"Bob", 1},
+		"tags":   map[string]string{"a": "b"},
+		"list":   []int{1, 2},
+		"point":  point{1, 2},
+		"ptr":    &point{3, 4},
+		"err":    &rowError{1, "bad"},
+		"time":   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		"name":   "Bob",
+		"number": 42,
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+		err      string
+	}{
+		{`{{user}}`, "", "line 1: cannot interpolate user of type mustache.User"},
+		{`{{{tags}}}`, "", "line 1: cannot interpolate tags of type map[string]string"},
+		{`{{list}}`, "", "line 1: cannot interpolate list of type []int"},
+		{`{{point}} {{ptr}} {{err}}`, "(1, 2) (3, 4) row 1: bad", ""},
+		{`{{time}}`, "2024-01-02 03:04:05 +0000 UTC", ""},
+		{`{{name}} {{number}} {{user.Name}} {{#list}}{{.}}{{/list}}`, "Bob 42 Bob 12", ""},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithStrictTypes(true).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q expected error %q got %v", test.tmpl, test.err, err)
+			}
+		} else if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithStrictTypes(true).WithEscapeMode(EscapeJSON).CompileString(`{{list}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(context); err != nil {
+		t.Errorf("expected no error in JSON mode, got %v", err)
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	context := map[string]interface{}{
+		"rows": make([]struct{}, 1000),
+		"lambda": func(text string, render RenderFn) (string, error) {
+			return render(strings.Repeat(text, 100))
+		},
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+		err      error
+	}{
+		{`{{#rows}}0123456789{{/rows}}`, strings.Repeat("0123456789", 10), ErrOutputTooLarge},
+		{`{{#rows}}01234{{/rows}}`, strings.Repeat("01234", 20), ErrOutputTooLarge},
+		{`{{#rows}}{{/rows}}done`, "done", nil},
+		{`{{#lambda}}{{#rows}}x{{/rows}}{{/lambda}}`, "", ErrOutputTooLarge},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithMaxOutputBytes(100).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = tmpl.Frender(&buf, context)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q expected error %v got %v", test.tmpl, test.err, err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, buf.String())
+		}
+		output, err := tmpl.Render(context)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q expected error %v got %v", test.tmpl, test.err, err)
+		}
+		if int64(len(output)) > 100 {
+			t.Errorf("%q rendered %d bytes", test.tmpl, len(output))
+		}
+	}
+}
+
+func TestMaxIterations(t *testing.T) {
+	var pulled int
+	numbers := func(yield func(int) bool) {
+		for n := 0; n < 11; n++ {
+			pulled++
+			if !yield(n) {
+				return
+			}
+		}
+	}
+	context := map[string]interface{}{
+		"ten":     make([]int, 10),
+		"eleven":  make([]int, 11),
+		"array":   [11]int{},
+		"map":     map[int]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 10: 10, 11: 11},
+		"numbers": numbers,
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+		err      error
+	}{
+		{`{{#ten}}x{{/ten}}`, "xxxxxxxxxx", nil},
+		{`{{#eleven}}x{{/eleven}}`, "", ErrIterationLimitExceeded},
+		{`{{^eleven}}none{{/eleven}}`, "", nil},
+		{`{{#array}}x{{/array}}`, "", ErrIterationLimitExceeded},
+		{`{{#each eleven}}x{{/each}}`, "", ErrIterationLimitExceeded},
+		{`{{#each map}}x{{/each}}`, "", ErrIterationLimitExceeded},
+		{`{{#numbers}}{{.}}{{/numbers}}`, "0123456789", ErrIterationLimitExceeded},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithMaxIterations(10).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q expected error %v got %v", test.tmpl, test.err, err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+	if pulled != 11 {
+		t.Errorf("expected 11 values to be pulled from the iterator, got %d", pulled)
+	}
+}
+
+type cyclicNode struct {
+	Name string
+	Node *cyclicNode
+}
+
+func TestMaxContextDepth(t *testing.T) {
+	node := &cyclicNode{Name: "a"}
+	node.Node = node
+	context := map[string]interface{}{"node": node, "list": []int{1, 2, 3}}
+	tests := []struct {
+		tmpl     string
+		expected string
+		err      error
+	}{
+		{`{{#node}}{{Name}}{{#Node}}{{Name}}{{/Node}}{{/node}}`, "aa", nil},
+		{`{{#node}}{{#Node}}{{#Node}}{{Name}}{{/Node}}{{/Node}}{{/node}}`, "", ErrContextTooDeep},
+		{`{{#node}}{{Name}}{{>@self}}{{/node}}`, "aa", ErrContextTooDeep},
+		{`{{#node}}{{Name}}{{#Node}}{{>@self}}{{/Node}}{{/node}}`, "a", ErrContextTooDeep},
+		// Iterating over a list is one level, and inverted sections aren't counted.
+		{`{{#list}}{{.}}{{#node}}{{^missing}}{{Name}}{{/missing}}{{/node}}{{/list}}`, "1a2a3a", nil},
+		{`{{#list}}{{#each list}}{{#node}}{{Name}}{{/node}}{{/each}}{{/list}}`, "", ErrContextTooDeep},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithMaxContextDepth(2).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q expected error %v got %v", test.tmpl, test.err, err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+type money int64 // in cents
+
+func TestImplicitIteratorFormat(t *testing.T) {
+	floats := map[reflect.Type]TypeStringer{
+		reflect.TypeOf(0.0): func(v interface{}) (string, bool) { return fmt.Sprintf("%.2f", v), true },
+	}
+	values := []interface{}{1.1, 2.0, true, `"<a & b>"`, []byte("<bytes>"), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		money(150)}
+	for _, mode := range []EscapeMode{EscapeHTML, EscapeJSON, Raw} {
+		cmpl := New().WithEscapeMode(mode).WithTypeStringer(floats).WithBoolFormat("yes", "no")
+		named, err := cmpl.CompileString("{{v}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// {{.}} in a list, in a section over the value, and in a section over {{.}} itself
+		implicit, err := cmpl.CompileString("{{#list}}{{.}}{{/list}}|{{#v}}{{.}}{{/v}}|{{#list}}{{#.}}{{.}}{{/.}}{{/list}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range values {
+			data := map[string]interface{}{"v": v, "list": []interface{}{v}}
+			expected, err := named.Render(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := implicit.Render(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != expected+"|"+expected+"|"+expected {
+				t.Errorf("mode %d, %#v: expected {{.}} to render %q like {{v}}, got %q", mode, v, expected, output)
+			}
+		}
+	}
+
+	tmpl, err := New().WithTypeStringer(floats).CompileString("{{#list}}({{.}}){{/list}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, err := tmpl.Render(map[string][]float64{"list": {1.1, 2, 3.14159}}); err != nil || output != "(1.10)(2.00)(3.14)" {
+		t.Errorf("expected formatted floats, got %q (%v)", output, err)
+	}
+}
+
+func TestTypeStringer(t *testing.T) {
+	stringers := map[reflect.Type]TypeStringer{
+		reflect.TypeOf(money(0)): func(v interface{}) (string, bool) {
+			m := v.(money)
+			return fmt.Sprintf("$%d.%02d", m/100, m%100), m != 0
+		},
+	}
+	price := money(250)
+	context := map[string]interface{}{
+		"total":    money(123),
+		"discount": money(0),
+		"price":    &price,
+		"prices":   []money{5, 1000},
+		"none":     (*money)(nil),
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{total}} {{price}}`, "$1.23 $2.50"},
+		{`[{{discount}}]`, "[]"},
+		{`{{#discount}}-{{.}}{{/discount}}{{^discount}}no discount{{/discount}}`, "no discount"},
+		{`{{#total}}paid {{.}}{{/total}}`, "paid $1.23"},
+		{`{{#prices}}{{.}} {{/prices}}`, "$0.05 $10.00 "},
+		{`{{^none}}none{{/none}}`, "none"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithTypeStringer(stringers).WithStrictTypes(true).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	// Setting a function later doesn't change the templates already compiled.
+	compiler := New().WithTypeStringer(stringers)
+	tmpl, err := compiler.CompileString(`{{total}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler.WithTypeStringer(map[reflect.Type]TypeStringer{
+		reflect.TypeOf(money(0)): func(v interface{}) (string, bool) { return "free", true },
+	})
+	if output, err := tmpl.Render(context); err != nil || output != "$1.23" {
+		t.Errorf("expected %q got %q, %v", "$1.23", output, err)
+	}
+}
+
+type optionalView struct {
+	name string
+}
+
+func (v optionalView) MaybeName() (string, bool) {
+	return v.name, v.name != ""
+}
+
+func (v *optionalView) MaybeUpper() (string, bool) {
+	return strings.ToUpper(v.name), v.name != ""
+}
+
+func (v optionalView) Count() (int, bool) {
+	return 0, true
+}
+
+func TestPresenceMethods(t *testing.T) {
+	tests := []struct {
+		template string
+		name     string
+		expected string
+	}{
+		{"{{MaybeName}}", "Bob", "Bob"},
+		{"{{MaybeName}}", "", ""},
+		{"{{#MaybeName}}[{{.}}]{{/MaybeName}}", "Bob", "[Bob]"},
+		{"{{#MaybeName}}[{{.}}]{{/MaybeName}}", "", ""},
+		{"{{^MaybeName}}none{{/MaybeName}}", "Bob", ""},
+		{"{{^MaybeName}}none{{/MaybeName}}", "", "none"},
+		{"{{MaybeUpper}} {{#MaybeUpper}}{{.}}{{/MaybeUpper}}", "Bob", "BOB BOB"},
+		{"{{MaybeUpper}}{{^MaybeUpper}}none{{/MaybeUpper}}", "", "none"},
+		// A present value is still true or false in sections as usual.
+		{"{{Count}}{{^Count}} is false{{/Count}}", "", "0 is false"},
+	}
+	for _, test := range tests {
+		// Missing values aren't errors, as for a nil pointer.
+		tmpl, err := New().WithErrors(true).CompileString(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []interface{}{optionalView{test.name}, &optionalView{test.name}} {
+			if _, ok := data.(optionalView); ok && strings.Contains(test.template, "MaybeUpper") {
+				// pointer methods need an addressable value
+				continue
+			}
+			output, err := tmpl.Render(data)
+			if err != nil {
+				t.Errorf("%q with %q: %v", test.template, test.name, err)
+			} else if output != test.expected {
+				t.Errorf("%q with %q: expected %q got %q", test.template, test.name, test.expected, output)
+			}
+		}
+	}
+}
+
+func TestPointerValues(t *testing.T) {
+	type profile struct {
+		Nickname *string
+		Age      *int
+		Score    *float64
+		Public   *bool
+	}
+	nickname, score, public := "annie", 9.5, false
+	context := map[string]interface{}{
+		"profile": profile{Nickname: &nickname, Score: &score, Public: &public},
+		"count":   (*int)(nil),
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{profile.Nickname}} {{profile.Score}} {{profile.Public}}`, "annie 9.5 false"},
+		{`[{{profile.Age}}][{{count}}]`, "[][]"},
+		{`{{#profile.Age}}age{{/profile.Age}}{{^profile.Age}}no age{{/profile.Age}}`, "no age"},
+		{`{{#count}}count{{/count}}{{^count}}no count{{/count}}`, "no count"},
+		{`{{#profile.Public}}public{{/profile.Public}}{{^profile.Public}}private{{/profile.Public}}`, "private"},
+		{`{{#profile.Nickname}}({{.}}){{/profile.Nickname}}`, "(annie)"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestTrimStandaloneComments(t *testing.T) {
+	tests := []struct {
+		tmpl     string
+		trimmed  string
+		standard string
+	}{
+		{"a\n  {{! comment }}\nb\n", "a\nb\n", "a\nb\n"},
+		{"a\n{{! one }} {{! two }}\t\nb\n", "a\nb\n", "a\n \t\nb\n"},
+		{"a\r\n  {{!one}}{{!two}}\r\nb", "a\r\nb", "a\r\n  \r\nb"},
+		{"a\n{{!one}}{{!multi\nline}}", "a\n", "a\n"},
+		{"a\n{{!one}}{{b}}\n", "a\nB\n", "a\nB\n"},
+		{"a {{!one}}{{!two}}\nb", "a \nb", "a \nb"},
+		{"{{#s}}\n{{!one}}{{!two}}\n{{b}}\n{{/s}}", "B\n", "\nB\n"},
+	}
+	for _, test := range tests {
+		for _, trim := range []bool{true, false} {
+			tmpl, err := New().WithAutoTrimStandaloneComments(trim).CompileString(test.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := tmpl.Render(map[string]interface{}{"b": "B", "s": true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := test.standard
+			if trim {
+				expected = test.trimmed
+			}
+			if output != expected {
+				t.Errorf("%q with trimming %v: expected %q got %q", test.tmpl, trim, expected, output)
+			}
+		}
+	}
+
+	// Lines are still counted for errors after a trimmed line.
+	tmpl, err := New().WithAutoTrimStandaloneComments(true).WithErrors(true).CompileString("{{!a}}{{!\n}}\n{{x}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(nil); err == nil || err.Error() != `line 3: missing variable "x"` {
+		t.Errorf("expected an error at line 3, got %v", err)
+	}
+}
+
+func TestSectionFilter(t *testing.T) {
+	type user struct {
+		Name  string
+		Admin bool
+	}
+	admins := func(elem interface{}) bool { return elem.(user).Admin }
+	context := map[string]interface{}{
+		"users":  []user{{"Ann", true}, {"Bob", false}, {"Cy", true}},
+		"guests": []user{{"Dee", false}},
+		"all":    []user{{"Eve", false}},
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{#users}}{{Name}},{{/users}}`, "Ann,Cy,"},
+		{`{{#each users}}{{@index}}{{Name}}{{/each}}`, "0Ann1Cy"},
+		{`{{#guests}}{{Name}}{{/guests}}{{^guests}}no admins{{/guests}}`, "no admins"},
+		{`{{#guests}}{{Name}}{{else}}none{{/guests}}`, "none"},
+		{`{{#all}}{{Name}}{{/all}}`, "Eve"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithSectionFilter("users", admins).WithSectionFilter("guests", admins).CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	// Setting a filter later doesn't change the templates already compiled.
+	compiler := New().WithSectionFilter("users", admins)
+	tmpl, err := compiler.CompileString(`{{#all}}{{Name}}{{/all}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler.WithSectionFilter("all", admins)
+	if output, err := tmpl.Render(context); err != nil || output != "Eve" {
+		t.Errorf("expected %q got %q, %v", "Eve", output, err)
+	}
+}
+
+func TestTrimValues(t *testing.T) {
+	type label string
+	context := map[string]interface{}{
+		"s":     "  hello  ",
+		"named": label(" named\t"),
+		"n":     42,
+		"list":  []string{" a ", " b "},
+	}
+	tests := []struct {
+		tmpl     string
+		trimmed  string
+		original string
+	}{
+		{`[{{s}}]`, "[hello]", "[  hello  ]"},
+		{`[{{{s}}}]`, "[hello]", "[  hello  ]"},
+		{`[{{named}}]`, "[named]", "[ named\t]"},
+		{`[{{n}}]`, "[42]", "[42]"},
+		{`[{{list}}]`, "[[ a   b ]]", "[[ a   b ]]"},
+		{`{{#list}}[{{.}}]{{/list}}`, "[a][b]", "[ a ][ b ]"},
+	}
+	for _, test := range tests {
+		for _, trim := range []bool{true, false} {
+			tmpl, err := New().WithTrimValues(trim).CompileString(test.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := tmpl.Render(context)
+			if err != nil {
+				t.Error(err)
+			}
+			expected := test.original
+			if trim {
+				expected = test.trimmed
+			}
+			if output != expected {
+				t.Errorf("%q with trim %v expected %q got %q", test.tmpl, trim, expected, output)
+			}
+		}
+	}
+}
+
+func TestWhitespaceTruthy(t *testing.T) {
+	tests := []struct {
+		value  string
+		truthy string
+		falsy  string
+	}{
+		{"\t", "yes", "no"},
+		{" ", "yes", "no"},
+		{"\u00a0\n", "yes", "no"},
+		{"", "no", "no"},
+		{"x", "yes", "yes"},
+	}
+	for _, test := range tests {
+		for _, truthy := range []bool{true, false} {
+			tmpl, err := New().WithWhitespaceTruthy(truthy).CompileString(`{{#a}}yes{{/a}}{{^a}}no{{/a}}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := tmpl.Render(map[string]string{"a": test.value})
+			if err != nil {
+				t.Error(err)
+			}
+			expected := test.falsy
+			if truthy {
+				expected = test.truthy
+			}
+			if output != expected {
+				t.Errorf("%q with whitespace truthy %v expected %q got %q", test.value, truthy, expected, output)
+			}
+		}
+	}
+}
+
+func TestZeroTruthy(t *testing.T) {
+	tests := []struct {
+		context interface{}
+		truthy  string
+		falsy   string
+	}{
+		{0, "[0]", "none"},
+		{0.0, "[0]", "none"},
+		{uint8(0), "[0]", "none"},
+		{[]int{0}, "[0]", "[0]"},
+		{false, "none", "none"},
+		{"", "none", "none"},
+		{[]int{}, "none", "none"},
+		{nil, "none", "none"},
+	}
+	for _, test := range tests {
+		for _, truthy := range []bool{true, false} {
+			tmpl, err := New().WithZeroTruthy(truthy).CompileString(`{{#a}}[{{.}}]{{/a}}{{^a}}none{{/a}}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := tmpl.Render(map[string]interface{}{"a": test.context})
+			if err != nil {
+				t.Error(err)
+			}
+			expected := test.falsy
+			if truthy {
+				expected = test.truthy
+			}
+			if output != expected {
+				t.Errorf("%#v with zero truthy %v expected %q got %q", test.context, truthy, expected, output)
+			}
+		}
+	}
+}
+
+func TestNumericSectionThreshold(t *testing.T) {
+	tests := []struct {
+		threshold float64
+		score     interface{}
+		expected  string
+	}{
+		{0, 40, "[40]"},
+		{0, 60, "[60]"},
+		{0, -5, "none"},
+		{50, 40, "none"},
+		{50, 60, "[60]"},
+		{50, 50.0, "none"},
+		{50, uint8(51), "[51]"},
+		{50, 50.5, "[50.5]"},
+		{50, "40", "[40]"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithNumericSectionThreshold(test.threshold).
+			CompileString(`{{#score}}[{{.}}]{{/score}}{{^score}}none{{/score}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(map[string]interface{}{"score": test.score})
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%v over %#v expected %q got %q", test.threshold, test.score, test.expected, output)
+		}
+	}
+
+	// without a threshold, negative numbers are truthy; zero can still be made truthy
+	tmpl, err := New().CompileString(`{{#score}}yes{{/score}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, _ := tmpl.Render(map[string]int{"score": -5}); output != "yes" {
+		t.Errorf("expected -5 to be truthy without a threshold, got %q", output)
+	}
+	tmpl, err = New().WithNumericSectionThreshold(10).WithZeroTruthy(true).CompileString(`{{#score}}yes{{/score}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, _ := tmpl.Render(map[string]int{"score": 0}); output != "yes" {
+		t.Errorf("expected 0 to be truthy with WithZeroTruthy, got %q", output)
+	}
+}
+
+type sentinel string
+
+const unset sentinel = "<unset>"
+
+func TestTruthyFunc(t *testing.T) {
+	truthy := func(value interface{}) bool {
+		return value != nil && value != unset
+	}
+	tests := []struct {
+		context  interface{}
+		expected string
+	}{
+		{unset, "no"},
+		{sentinel("x"), "[x]"},
+		{0, "[0]"},
+		{"", "[]"},
+		{false, "[false]"},
+		{[]int{1, 2}, "[1][2]"},
+		{[]int{}, ""},
+		{nil, "no"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithTruthyFunc(truthy).CompileString(`{{#a}}[{{.}}]{{/a}}{{^a}}no{{/a}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(map[string]interface{}{"a": test.context})
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%#v expected %q got %q", test.context, test.expected, output)
+		}
+	}
+}
+
+// Make sure bugs caught by fuzz testing don't creep back in
+func TestCompileLimits(t *testing.T) {
+	limits := CompileLimits{MaxBytes: 100, MaxTags: 10, MaxDepth: 3}
+	tests := []struct {
+		tmpl string
+		err  string
+	}{
+		{`{{#a}}{{#b}}{{#c}}{{d}}{{/c}}{{/b}}{{/a}} {{! ok }}`, ""},
+		{strings.Repeat("x", 101), "template is 101 bytes, more than the limit of 100"},
+		{strings.Repeat("{{a}}", 11), "line 1: more than the limit of 10 tags"},
+		{"{{#a}}\n{{#b}}\n{{#c}}\n{{#d}}{{/d}}{{/c}}{{/b}}{{/a}}", "line 4: sections nested more than the limit of 3 deep"},
+	}
+	for _, test := range tests {
+		_, err := New().WithCompileLimits(limits).CompileString(test.tmpl)
+		if test.err == "" && err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%q: expected error %q got %v", test.tmpl, test.err, err)
+		}
+		if _, err := New().CompileString(test.tmpl); err != nil {
+			t.Errorf("%q without limits: %v", test.tmpl, err)
+		}
+	}
+
+	// partials are compiled with the same limits
+	tmpl, err := New().WithCompileLimits(limits).WithErrors(true).
+		WithPartials(&StaticProvider{map[string]string{"big": strings.Repeat("{{a}}", 20)}}).CompileString(`{{>big}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(nil); err == nil || !strings.Contains(err.Error(), "limit of 10 tags") {
+		t.Errorf("expected the partial to exceed the tag limit, got %v", err)
+	}
+}
+
+func TestCrashers(t *testing.T) {
+	crashers := []string{
+		`{{#}}{{#}}{{#}}{{#}}{{#}}{{=}}`,
+		`{{#}}{{#}}{{#}}{{#}}{{#}}{{#}}{{#}}{{#}}{{=}}`,
+		`{{=}}`,
+	}
+	for i, c := range crashers {
+		t.Log(i)
+		_, err := New().CompileString(c)
+		if err == nil {
+			t.Error(err)
+		}
+	}
+}
+
+/*
+func TestSectionPartial(t *testing.T) {
+    filename := path.Join(path.Join(os.Getenv("PWD"), "tests"), "test3.mustache")
+    expected := "Mike\nJoe\n"
+    context := map[string]interface{}{"users": []User{{"Mike", 1}, {"Joe", 2}}}
+    output := RenderFile(filename, context)
+    if output != expected {
+        t.Fatalf("testSectionPartial expected %q got %q", expected, output)
+    }
+}
+*/
+func TestWriterTo(t *testing.T) {
+	tmpl, err := New().WithErrors(true).CompileString(`Hello {{name}}!`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt := tmpl.WriterTo(map[string]string{"name": "World"})
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		n, err := wt.WriteTo(&buf)
+		if err != nil {
+			t.Error(err)
+		}
+		if buf.String() != "Hello World!" || n != int64(buf.Len()) {
+			t.Errorf("expected %q got %q (%d bytes)", "Hello World!", buf.String(), n)
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := tmpl.WriterTo(map[string]string{}).WriteTo(&buf)
+	if err == nil {
+		t.Error("expected error for missing variable")
+	}
+	if n != 6 {
+		t.Errorf("expected 6 bytes written before the error, got %d", n)
+	}
+}
+
+func TestRenderSize(t *testing.T) {
+	tmpl, err := New().CompileString(`{{#items}}<li>{{.}}</li>{{/items}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := map[string]interface{}{"items": []string{"a", "<b>", "ç"}}
+	output, err := tmpl.Render(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := tmpl.RenderSize(context)
+	if err != nil {
+		t.Error(err)
+	} else if size != len(output) {
+		t.Errorf("expected size %d got %d", len(output), size)
+	}
+	var buf bytes.Buffer
+	n, err := tmpl.FrenderN(&buf, context)
+	if err != nil {
+		t.Error(err)
+	} else if n != len(output) || buf.String() != output {
+		t.Errorf("expected %q (%d bytes) got %q (%d bytes)", output, len(output), buf.String(), n)
+	}
+}
+
+func TestRenderStats(t *testing.T) {
+	tmpl, err := New().WithPartials(&StaticProvider{map[string]string{"item": "<li>{{name}}</li>"}}).
+		CompileString(`{{title}}{{#items}}{{>item}}{{/items}}{{^items}}none{{/items}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := map[string]interface{}{
+		"title": "list",
+		"items": []map[string]string{{"name": "a"}, {"name": "b"}, {"name": "c"}},
+	}
+	output, stats, err := tmpl.RenderStats(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "list<li>a</li><li>b</li><li>c</li>"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	// title, both sections, and each partial with the variable inside it
+	if stats.Tags != 9 {
+		t.Errorf("expected 9 tags got %d", stats.Tags)
+	}
+	if stats.Partials != 3 {
+		t.Errorf("expected 3 partial fetches got %d", stats.Partials)
+	}
+	if stats.Bytes != len(output) {
+		t.Errorf("expected %d bytes got %d", len(output), stats.Bytes)
+	}
+}
+
+func TestMultiContext(t *testing.T) {
+	tmpl, err := New().CompileString(`{{hello}} {{World}}`)
+	if err != nil {
+		t.Error(err)
+	}
+	output, err := tmpl.Render(map[string]string{"hello": "hello"}, struct{ World string }{"world"})
+	if err != nil {
+		t.Error(err)
+	}
+	tmpl2, err := New().CompileString(`{{hello}} {{World}}`)
+	if err != nil {
+		t.Error(err)
+	}
+	output2, err := tmpl2.Render(struct{ World string }{"world"}, map[string]string{"hello": "hello"})
+	if err != nil {
+		t.Error(err)
+	}
+	if output != "hello world" || output2 != "hello world" {
+		t.Errorf("TestMultiContext expected %q got %q", "hello world", output)
+	}
+}
+
+func TestReflectValueContext(t *testing.T) {
+	tmpl, err := New().CompileString(`{{Name}} {{ID}} {{Func2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(reflect.ValueOf(&User{"Mike", 1}))
+	if err != nil {
+		t.Error(err)
+	}
+	expected := "Mike 1 Mike"
+	if output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+}
+
+func lambda(text string, render RenderFn, res string, data map[string]interface{}) (string, error) {
+	d, err := render(text)
+	data[res] = d
+	if err == nil {
+		return "OK", nil
+	}
+	return "", err
+}
+
+func TestLambda(t *testing.T) {
+	templ := `Call:{{#lambda}}hello {{lookup}} {{#sub}}{{.}} {{/sub}}{{^negsub}}nothing{{/negsub}}{{/lambda}};Result:{{result}}`
+	data := make(map[string]interface{})
+	data["lookup"] = "world"
+	data["sub"] = []string{"subv1", "subv2"}
+	data["negsub"] = nil
+	data["lambda"] = func(text string, render RenderFn) (string, error) {
+		return lambda(text, render, "result", data)
+	}
+	tmpl, err := New().CompileString(templ)
+	if err != nil {
+		t.Error(err)
+	}
+	output, _ := tmpl.Render(templ, data)
+	expect := "Call:OK;Result:hello world subv1 subv2 nothing"
+	if output != expect {
+		t.Fatalf("TestMultiContext expected %q got %q", expect, output)
+	}
+}
+
+func TestLambdaError(t *testing.T) {
+	templ := `stop_at_error.{{#lambda}}{{/lambda}}.never_here`
+	data := make(map[string]interface{})
+	data["lambda"] = func(text string, render RenderFn) (string, error) {
+		return "", fmt.Errorf("test err")
+	}
+	tmpl, err := New().CompileString(templ)
+	if err != nil {
+		t.Error(err)
+	}
+	output, _ := tmpl.Render(data)
+	expect := "stop_at_error."
+	if output != expect {
+		t.Fatalf("TestLambdaError expected %q got %q", expect, output)
+	}
+}
+
+var malformed = []Test{
+	{`{{#a}}{{}}{{/a}}`, Data{true, "hello"}, "", fmt.Errorf("line 1: empty tag")},
+	{`{{}}`, nil, "", fmt.Errorf("line 1: empty tag")},
+	{`{{}`, nil, "", fmt.Errorf("line 1: unmatched open tag")},
+	{`{{`, nil, "", fmt.Errorf("line 1: unmatched open tag")},
+	// invalid syntax - https://github.com/hoisie/mustache/issues/10
+	{`{{#a}}{{#b}}{{/a}}{{/b}}}`, map[string]interface{}{}, "", fmt.Errorf("line 1: interleaved closing tag: a")},
+	{`{{=}}`, nil, "", fmt.Errorf("line 1: invalid set delimiter")},
+	{`{{==}}`, nil, "", fmt.Errorf("line 1: invalid set delimiter")},
+	{`{{=  =}}`, nil, "", fmt.Errorf("line 1: invalid set delimiter")},
+	{"\n\n{{= a =}}", nil, "", fmt.Errorf("line 3: invalid set delimiter")},
+	{`{{=<% %> %%=}}`, nil, "", fmt.Errorf("line 1: invalid set delimiter")},
+	{`{{= {{ }} =}}`, nil, "", fmt.Errorf("line 1: invalid set delimiter")},
+	{`{{=<%= %>=}}`, nil, "", fmt.Errorf("line 1: invalid set delimiter")},
+	{`{{=<% %>=}}<%={{ }}%>`, nil, "", fmt.Errorf("line 1: invalid set delimiter")},
+}
+
+func TestMalformed(t *testing.T) {
+	for _, test := range malformed {
+		tmpl, err := New().CompileString(test.tmpl)
+		var output string
+		if err == nil {
+			output, err = tmpl.Render(test.context)
+		}
+		if err != nil {
+			if test.err == nil {
+				t.Error(err)
+			} else if test.err.Error() != err.Error() {
+				t.Errorf("%q expected error %q but got error %q", test.tmpl, test.err.Error(), err.Error())
+			}
+		} else {
+			if test.err == nil {
+				t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+			} else {
+				t.Errorf("%q expected error %q but got %q", test.tmpl, test.err.Error(), output)
+			}
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	tests := []Test{
+		{`{{#with user}}{{Name}}{{/with}}`, map[string]interface{}{"user": User{"Mike", 1}}, "Mike", nil},
+		{`{{#with user}}{{Name}}{{/with}}`, map[string]interface{}{"user": map[string]string{"Name": "Mike"}}, "Mike", nil},
+		{`{{# with  user }}{{Name}}{{/ with }}`, map[string]interface{}{"user": &User{"Mike", 1}}, "Mike", nil},
+		// a slice is pushed on to the context rather than iterated over
+		{`{{#with users}}[{{#.}}{{Name}}{{/.}}]{{/with}}`, map[string]interface{}{"users": []User{{"Mike", 1}, {"Joe", 2}}}, "[MikeJoe]", nil},
+		{`{{#with users}}{{Name}}{{/with}}`, map[string]interface{}{"users": []User{{"Mike", 1}}, "Name": "outer"}, "outer", nil},
+		// falsy values skip the block
+		{`{{#with user}}gone{{/with}}`, map[string]interface{}{"user": nil}, "", nil},
+		{`{{#with users}}gone{{/with}}`, map[string]interface{}{"users": []User{}}, "", nil},
+		{`{{#with user}}gone{{/with}}`, map[string]interface{}{}, "", nil},
+		{`{{^with user}}none{{/with}}`, map[string]interface{}{"user": nil}, "none", nil},
+		// a section with no argument is still a section named "with"
+		{`{{#with}}{{.}}{{/with}}`, map[string]interface{}{"with": []string{"a", "b"}}, "ab", nil},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		output, err := tmpl.Render(test.context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	_, err := New().CompileString(`{{#with user}}{{/user}}`)
+	if err == nil || err.Error() != "line 1: interleaved closing tag: user" {
+		t.Errorf("expected interleaved closing tag error, got %v", err)
+	}
+}
+
+func TestEach(t *testing.T) {
+	tests := []Test{
+		// slices and arrays
+		{`{{#each list}}{{@index}}={{@value}};{{/each}}`, map[string]interface{}{"list": []string{"a", "b", "c"}}, "0=a;1=b;2=c;", nil},
+		{`{{#each list}}{{@index}}={{.}};{{/each}}`, map[string]interface{}{"list": [2]int{5, 6}}, "0=5;1=6;", nil},
+		{`{{#each users}}{{@index}}:{{Name}} {{/each}}`, map[string]interface{}{"users": []*User{{"Mike", 1}, {"Joe", 2}}}, "0:Mike 1:Joe ", nil},
+		{`{{#each users}}{{@value.Name}}{{/each}}`, map[string]interface{}{"users": []User{{"Mike", 1}}}, "Mike", nil},
+		// maps are iterated over in key order
+		{`{{#each m}}{{@index}}:{{@key}}={{@value}};{{/each}}`, map[string]interface{}{"m": map[string]int{"b": 2, "a": 1, "c": 3}}, "0:a=1;1:b=2;2:c=3;", nil},
+		{`{{#each m}}{{@key}}={{.}};{{/each}}`, map[string]interface{}{"m": map[int]string{10: "x", 2: "y"}}, "2=y;10=x;", nil},
+		{`{{#each m}}{{@key}}={{Name}};{{/each}}`, map[string]interface{}{"m": map[string]User{"mike": {"Mike", 1}}}, "mike=Mike;", nil},
+		// a map is iterated over, even though a section would use it as the context
+		{`{{#each m}}{{a}}{{/each}}`, map[string]interface{}{"m": map[string]string{"a": "x"}, "a": "outer"}, "outer", nil},
+		// scalars have no elements
+		{`{{#each s}}{{.}}{{/each}}`, map[string]interface{}{"s": "string"}, "", nil},
+		{`{{#each s}}{{.}}{{/each}}`, map[string]interface{}{"s": 42}, "", nil},
+		{`{{^each s}}none{{/each}}`, map[string]interface{}{"s": 42}, "none", nil},
+		// empty and missing values
+		{`{{#each list}}{{.}}{{/each}}`, map[string]interface{}{"list": []string{}}, "", nil},
+		{`{{^each list}}none{{/each}}`, map[string]interface{}{"list": []string{}}, "none", nil},
+		{`{{^each m}}none{{/each}}`, map[string]interface{}{"m": map[string]string{}}, "none", nil},
+		{`{{^each list}}none{{/each}}`, map[string]interface{}{}, "none", nil},
+		{`{{^each list}}none{{/each}}`, map[string]interface{}{"list": []string{"a"}}, "", nil},
+		// nested blocks bind their own metadata
+		{`{{#each rows}}{{#each .}}{{@index}}{{.}}{{/each}};{{/each}}`, map[string]interface{}{"rows": [][]string{{"a", "b"}, {"c"}}}, "0a1b;0c;", nil},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		output, err := tmpl.Render(test.context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	tests := []struct {
+		template string
+		depth    int
+	}{
+		{"", 0},
+		{"Hello {{name}}! {{>footer}}", 0},
+		{"{{#a}}{{b}}{{/a}}", 1},
+		{"{{#a}}{{/a}}{{^b}}{{/b}}{{#c}}{{/c}}", 1},
+		{"{{#a}}{{#b}}{{^c}}{{d}}{{/c}}{{/b}}{{/a}}", 3},
+		{"{{#a}}{{#b}}{{/b}}{{/a}}{{#c}}{{#d}}{{#e}}{{/e}}{{/d}}{{/c}}{{#f}}{{/f}}", 3},
+		{"{{#a}}x{{else}}{{#b}}{{/b}}{{/a}}", 2},
+		{"{{#each items}}{{#with item}}{{/with}}{{/each}}", 2},
+		{`{{#define "row"}}{{#a}}{{#b}}{{/b}}{{/a}}{{/define}}{{#c}}{{/c}}`, 2},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth := tmpl.MaxDepth(); depth != test.depth {
+			t.Errorf("%q: expected depth %d got %d", test.template, test.depth, depth)
+		}
+	}
+}
+
+func TestUnpairedSections(t *testing.T) {
+	tmpl, err := New().CompileString(`{{#items}}{{name}}{{/items}}{{^items}}none{{/items}}` +
+		`{{#users}}{{#admin}}*{{/admin}}{{name}}{{/users}}` +
+		`{{^errors}}ok{{/errors}}` +
+		`{{#each tags}}{{.}}{{else}}no tags{{/each}}` +
+		`{{#define "footer"}}{{#links}}{{.}}{{/links}}{{/define}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"admin", "errors", "links", "users"}
+	if names := tmpl.UnpairedSections(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v got %v", expected, names)
+	}
+}
+
+func TestString(t *testing.T) {
+	tmpl, err := New().CompileString("<ul>\n  {{# items }}\n  <li>{{ name }} {{{ html }}} {{& html}}</li>\n  {{/ items }}\n</ul>\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<ul>\n{{#items}}\n  <li>{{name}} {{{html}}} {{{html}}}</li>\n{{/items}}\n</ul>\n"
+	if source := tmpl.String(); source != expected {
+		t.Errorf("expected %q got %q", expected, source)
+	}
+
+	cmpl := New().
+		WithFuncs(map[string]interface{}{"upper": strings.ToUpper}).
+		WithBlockHelpers(map[string]BlockHelperFn{
+			"eq": func(args []interface{}, context interface{}, body, inverse BlockRenderFn) (string, error) {
+				return body()
+			},
+		})
+	templates := []string{
+		"{{#a}}\n\nx\n{{/a}}",
+		"{{#a}}x{{/a}} {{^b}}y{{/b}}",
+		"a\n  {{!comment}}\n  {{#b}}\n    {{c.d}}\n  {{/b}}\n",
+		"  {{!c}}{{#a}}\nx{{/a}}{{!c}}\n",
+		"{{!c}}{{#a}}\nx{{/a}}",
+		"[\n  {{> item}}\n  {{>item}} x\n  {{!c}}{{>item}}\n{{>? missing}}{{>& raw}}{{>item  user}}\n]",
+		"  {{>item}}{{!c}}\n",
+		"{{=<% %>=}}<% a %> {{b}}\n<%#c%>\n<%={{ }}=%>{{d}}\n{{/c}}",
+		"{{#each  items}}{{@index}}{{else}}none{{/each}} {{#with user}}{{name}}{{/with}}",
+		"{{json  data}} {{plural count \"item\"  \"items\"}} {{upper  name}} {{upper \"a  b\"}}",
+		`{{#define "my footer"}}{{year}}{{/define}}{{#define header}}{{title}}{{/define}}{{#eq lang  "fr"}}oui{{else}}non{{/eq}}`,
+		"\r\n{{#a}}\r\nx\r\n{{/a}}\r\n",
+		"{{#a}}{{/a}}",
+	}
+	for _, src := range templates {
+		tmpl, err := cmpl.CompileString(src)
+		if err != nil {
+			t.Fatalf("%q: %v", src, err)
+		}
+		source := tmpl.String()
+		tmpl2, err := cmpl.CompileString(source)
+		if err != nil {
+			t.Errorf("%q: compiling %q: %v", src, source, err)
+			continue
+		}
+		if a, b := elementTree(tmpl), elementTree(tmpl2); a != b {
+			t.Errorf("%q: %q does not parse the same:\n%s\n%s", src, source, a, b)
+		}
+		if again := tmpl2.String(); again != source {
+			t.Errorf("%q: expected %q got %q", src, source, again)
+		}
+	}
+}
+
+func TestTagWhitespace(t *testing.T) {
+	data := map[string]interface{}{"a": map[string]string{"b": "B"}, "f": false, "h": "<i>"}
+	partials := &StaticProvider{map[string]string{"p": "P{{h}}"}}
+	tests := []struct {
+		spaced   string
+		compact  string
+		expected string
+	}{
+		{"{{# a }}x{{/ a }}", "{{#a}}x{{/a}}", "x"},
+		{"{{ # a }}x{{ / a }}", "{{#a}}x{{/a}}", "x"},
+		{"{{#\ta.b\t}}x{{/  a.b}}", "{{#a.b}}x{{/a.b}}", "x"},
+		{"{{^ f }}y{{/ f }}", "{{^f}}y{{/f}}", "y"},
+		{"{{ ^ f }}y{{ / f }}", "{{^f}}y{{/f}}", "y"},
+		{"{{#a}}x{{/ a }}", "{{#a}}x{{/a}}", "x"},
+		{"{{> p }}", "{{>p}}", "P&lt;i&gt;"},
+		{"{{ > p }}", "{{>p}}", "P&lt;i&gt;"},
+		{"{{& h }}", "{{&h}}", "<i>"},
+		{"{{ & h }}", "{{&h}}", "<i>"},
+		{"{{{ h }}}", "{{{h}}}", "<i>"},
+		{"{{! c }}z", "{{!c}}z", "z"},
+		{"{{ ! c }}z", "{{!c}}z", "z"},
+		{"{{= <% %> =}}<% h %>", "{{=<% %>=}}<%h%>", "&lt;i&gt;"},
+		{"{{ = <% %> = }}<%# a %>x<%/ a %>", "{{=<% %>=}}<%#a%>x<%/a%>", "x"},
+		{"  {{# a }}  \nx\n  {{/ a }}  \n", "{{#a}}\nx\n{{/a}}\n", "x\n"},
+	}
+	for _, test := range tests {
+		spaced, err := New().WithPartials(partials).CompileString(test.spaced)
+		if err != nil {
+			t.Errorf("%q: %v", test.spaced, err)
+			continue
+		}
+		compact, err := New().WithPartials(partials).CompileString(test.compact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !spaced.Equal(compact) {
+			t.Errorf("expected %q to be parsed the same as %q", test.spaced, test.compact)
+		}
+		output, err := spaced.Render(data)
+		if err != nil {
+			t.Errorf("%q: %v", test.spaced, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.spaced, test.expected, output)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(source string) string {
+		tmpl, err := New().CompileString(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tmpl.Fingerprint()
+	}
+	base := "<ul>\n{{#items}}\n  <li>{{name}} {{{html}}}</li>\n{{/items}}\n</ul>\n{{>footer}}"
+	fp := fingerprint(base)
+	if matched, _ := regexp.MatchString("^[0-9a-f]{64}$", fp); !matched {
+		t.Errorf("expected a hex SHA-256 hash, got %q", fp)
+	}
+	for _, same := range []string{
+		base,
+		"<ul>\n{{# items }}\n  <li>{{ name }} {{& html }}</li>\n{{/ items }}\n</ul>\n{{> footer }}",
+		"<ul>\n{{#items}}\n  <li>{{! a comment }}{{name}} {{{html}}}</li>\n{{/items}}\n</ul>\n{{>footer}}",
+		"<ul>\n{{#items}}\n  {{! a standalone comment }}\n  <li>{{name}} {{{html}}}</li>\n{{/items}}\n</ul>\n{{>footer}}",
+	} {
+		if got := fingerprint(same); got != fp {
+			t.Errorf("%q: expected the fingerprint %s, got %s", same, fp, got)
+		}
+	}
+	for _, different := range []string{
+		"<ul>\n{{#items}}\n <li>{{name}} {{{html}}}</li>\n{{/items}}\n</ul>\n{{>footer}}",
+		"<ul>\n{{^items}}\n  <li>{{name}} {{{html}}}</li>\n{{/items}}\n</ul>\n{{>footer}}",
+		"<ul>\n{{#items}}\n  <li>{{name}} {{html}}</li>\n{{/items}}\n</ul>\n{{>footer}}",
+		"<ul>\n{{#items}}\n  <li>{{title}} {{{html}}}</li>\n{{/items}}\n</ul>\n{{>footer}}",
+		"<ul>\n{{#items}}\n  <li>{{name}} {{{html}}}</li>\n</ul>\n{{/items}}\n{{>footer}}",
+		"<ul>\n{{#items}}\n  <li>{{name}} {{{html}}}</li>\n{{/items}}\n</ul>\n{{>header}}",
+	} {
+		if fingerprint(different) == fp {
+			t.Errorf("%q: expected a different fingerprint from %q", different, base)
+		}
+	}
+
+	// With partials, the fingerprint changes when a partial does, even one included by another partial.
+	partials := map[string]string{"footer": "<footer>{{>links}}</footer>", "links": "<a>{{ href }}</a>"}
+	tmpl, err := New().WithPartials(&StaticProvider{partials}).CompileString(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withPartials := func() string {
+		fp, err := tmpl.FingerprintPartials()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	first := withPartials()
+	if first == fp {
+		t.Error("expected the partials to change the fingerprint")
+	}
+	partials["links"] = "<a>{{href}}</a>"
+	if withPartials() != first {
+		t.Error("expected a whitespace-only change in a partial to keep the fingerprint")
+	}
+	partials["links"] = "<a>{{url}}</a>"
+	if withPartials() == first {
+		t.Error("expected a change in a nested partial to change the fingerprint")
+	}
+	delete(partials, "links")
+	if withPartials() == first {
+		t.Error("expected a missing partial to change the fingerprint")
+	}
+	partials["links"] = "{{#broken}}"
+	if _, err := tmpl.FingerprintPartials(); err == nil || !strings.HasPrefix(err.Error(), "links: ") {
+		t.Errorf("expected an error compiling the partial, got %v", err)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"Hello {{name}}!", "Hello {{name}}!", true},
+		{"Hello {{ name }}! {{{ raw }}}", "Hello {{name}}! {{&raw}}", true},
+		{"{{#items}}\n{{! the items }}\n{{.}}\n{{/items}}\n", "{{#items}}\n{{.}}\n{{/items}}\n", true},
+		{"{{#each  items}}{{.}}{{else}}none{{/each}}", "{{#each items}}{{.}}{{else}}none{{/each}}", true},
+		{"{{=<% %>=}}<%a%>", "{{=<%  %>=}}<% a %>", true},
+		{"Hello {{name}}!", "Hello {{name}}.", false},
+		{"Hello {{name}}!", "Hello {{{name}}}!", false},
+		{"{{#a}}x{{/a}}", "{{^a}}x{{/a}}", false},
+		{"{{#a}}{{b}}{{/a}}", "{{#a}}{{/a}}{{b}}", false},
+		{"{{#a}}x{{/a}}", "{{#a}}x{{else}}{{/a}}", false},
+		{"{{>p}}", "{{>p q}}", false},
+		{"{{=<% %>=}}<%a%>", "{{=<< >>=}}<<a>>", false},
+		{`{{#define "x"}}a{{/define}}`, `{{#define "x"}}b{{/define}}`, false},
+	}
+	for _, test := range tests {
+		a, err := New().CompileString(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New().CompileString(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Equal(b) != test.equal || b.Equal(a) != test.equal {
+			t.Errorf("%q and %q: expected Equal to be %v", test.a, test.b, test.equal)
+		}
+		if c, err := New().CompileString(a.String()); err != nil || !c.Equal(a) {
+			t.Errorf("%q: expected the template compiled from its String to be equal", test.a)
+		}
+	}
+}
+
+// elementTree describes the parsed elements of a template, joining adjacent text, for comparing templates.
+func elementTree(tmpl *Template) string {
+	var b strings.Builder
+	var write func(elems []interface{})
+	write = func(elems []interface{}) {
+		var text string
+		for _, element := range elems {
+			if elem, ok := element.(*textElement); ok {
+				text += string(elem.text)
+				continue
+			}
+			if text != "" {
+				fmt.Fprintf(&b, "%q ", text)
+				text = ""
+			}
+			switch elem := element.(type) {
+			case *varElement:
+				name := elem.name
+				if elem.fn.IsValid() {
+					name = "" // the whole tag, as written
+				}
+				fmt.Fprintf(&b, "var(%s %s %v %v %v) ", name, elem.helper, elem.args, elem.fn.IsValid(), elem.raw)
+			case *sectionElement:
+				name := elem.name
+				if elem.args != nil {
+					name = "" // the arguments, as written
+				}
+				fmt.Fprintf(&b, "section(%s %s %v %v)[ ", name, elem.helper, elem.args, elem.inverted)
+				write(elem.elems)
+				if elem.inverse != nil {
+					b.WriteString("else ")
+					write(elem.inverse)
+				}
+				b.WriteString("] ")
+			case *partialElement:
+				fmt.Fprintf(&b, "partial(%s %s %q %v %v) ", elem.name, elem.context, elem.indent, elem.optional, elem.raw)
+			case *delimElement:
+				fmt.Fprintf(&b, "delims(%s %s) ", elem.otag, elem.ctag)
+			}
+		}
+		if text != "" {
+			fmt.Fprintf(&b, "%q ", text)
+		}
+	}
+	names := make([]string, 0, len(tmpl.defines))
+	for name := range tmpl.defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "define(%s)[ ", name)
+		write(tmpl.defines[name])
+		b.WriteString("] ")
+	}
+	write(tmpl.elems)
+	return b.String()
+}
+
+func TestFuncs(t *testing.T) {
+	funcs := template.FuncMap{
+		"upper": strings.ToUpper,
+		"join":  func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"add":   func(a, b float64) float64 { return a + b },
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		},
+		"title": func() string { return "<Title>" },
+	}
+	context := map[string]interface{}{
+		"name":  "ann",
+		"count": 7,
+		"user":  map[string]string{"first": "Ann", "last": "Lee"},
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{upper name}}`, "ANN"},
+		{`{{upper "<b>"}} {{{upper "<b>"}}}`, "&lt;B&gt; <B>"},
+		{`{{join ", " user.first user.last "x y"}}`, "Ann, Lee, x y"},
+		{`{{join "-"}}`, ""},
+		{`{{add count 0.5}} {{add 1 -2}}`, "7.5 -1"},
+		{`{{div count 2}}`, "3"},
+		{`{{upper .name}}`, "ANN"},
+		{`[{{upper missing}}]`, "[]"},
+		{`{{title}}`, "&lt;Title&gt;"},
+		{`{{#user}}{{upper first}}{{/user}}`, "ANN"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithFuncs(funcs).CompileString(test.tmpl)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+			continue
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithFuncs(funcs).CompileString(`{{div count 0}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(context); err == nil || err.Error() != "line 1: div: division by zero" {
+		t.Errorf("expected division by zero error got %v", err)
+	}
+	for _, bad := range []string{`{{upper count}}`, `{{upper}}`, `{{upper name name}}`} {
+		tmpl, err = New().WithFuncs(funcs).CompileString(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tmpl.Render(context); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+
+	// Registering functions later doesn't change the templates already compiled.
+	compiler := New().WithFuncs(funcs)
+	tmpl, err = compiler.CompileString(`{{upper name}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler.WithFuncs(template.FuncMap{"upper": strings.ToLower})
+	if output, err := tmpl.Render(context); err != nil || output != "ANN" {
+		t.Errorf("expected %q got %q, %v", "ANN", output, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic registering a function with no results")
+		}
+	}()
+	New().WithFuncs(map[string]interface{}{"bad": func() {}})
+}
+
+func TestSectionElse(t *testing.T) {
+	context := map[string]interface{}{
+		"list":  []string{"a", "b"},
+		"empty": []string{},
+		"no":    false,
+		"user":  map[string]string{"name": "Ann"},
+		"title": "T",
+		"a":     map[string]string{"else": "x"},
+		"none":  false,
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{#list}}{{.}}{{else}}no items{{/list}}`, "ab"},
+		{`{{#empty}}{{.}}{{else}}no items{{/empty}}`, "no items"},
+		{`{{#no}}yes{{else}}no{{/no}}`, "no"},
+		{`{{#missing}}yes{{else}}{{title}}{{/missing}}`, "T"},
+		{`{{#with user}}{{name}}{{else}}anonymous{{/with}}`, "Ann"},
+		{`{{#each empty}}{{.}}{{else}}none{{/each}}`, "none"},
+		{`{{#list}}{{#no}}x{{else}}{{.}}{{/no}}{{/list}}`, "ab"},
+		{`{{^empty}}{{else}}{{/empty}}`, ""},
+		{"{{#list}}\n<li>{{.}}</li>\n{{else}}\n<li>none</li>\n{{/list}}\n", "<li>a</li>\n<li>b</li>\n"},
+		// When the data has a value named else, {{else}} is that value, as it was before sections had else parts.
+		{`{{#a}}{{else}}{{/a}}`, "x"},
+		{`{{#a}}[{{else}}]{{/a}}{{#none}}[{{else}}]{{/none}}`, "[x]]"},
+		{`{{#a}}{{#empty}}{{else}}{{/empty}}{{/a}}`, ""},
+		{`{{#with a}}{{else}}y{{/with}}`, ""},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+			continue
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestMapSectionMode(t *testing.T) {
+	data := map[string]interface{}{"counts": map[string]int{"b": 2, "a": 1}, "none": map[string]int{}}
+	template := "{{#counts}}[{{@key}}={{@value}} {{.}} {{a}}]{{/counts}}{{^none}}none{{/none}}"
+	tests := []struct {
+		mode     MapSectionMode
+		expected string
+	}{
+		{AsContext, "[= map[a:1 b:2] 1]"},
+		{AsPairs, "[a=1 1 ][b=2 2 ]none"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithMapSectionMode(test.mode).CompileString(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("mode %d: expected %q got %q", test.mode, test.expected, output)
+		}
+	}
+}
+
+func TestInvertedRequiresPresence(t *testing.T) {
+	template := "{{^admin}}denied{{/admin}}"
+	tests := []struct {
+		data     interface{}
+		expected string
+		strict   string // with WithErrors, or "error"
+	}{
+		{map[string]interface{}{}, "", "error"},
+		{map[string]interface{}{"admin": false}, "denied", "denied"},
+		{map[string]interface{}{"admin": nil}, "denied", "denied"},
+		{map[string]interface{}{"admin": true}, "", ""},
+	}
+	for _, test := range tests {
+		for _, errorOnMissing := range []bool{false, true} {
+			tmpl, err := New().WithInvertedRequiresPresence(true).WithErrors(errorOnMissing).CompileString(template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := test.expected
+			if errorOnMissing {
+				expected = test.strict
+			}
+			output, err := tmpl.Render(test.data)
+			if expected == "error" {
+				if err == nil {
+					t.Errorf("%v: expected an error, got %q", test.data, output)
+				}
+			} else if err != nil {
+				t.Errorf("%v, WithErrors(%t): %v", test.data, errorOnMissing, err)
+			} else if output != expected {
+				t.Errorf("%v, WithErrors(%t): expected %q got %q", test.data, errorOnMissing, expected, output)
+			}
+		}
+	}
+
+	// Without the option, a missing value renders the inverted section as the spec requires.
+	tmpl, err := New().WithErrors(true).CompileString(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, err := tmpl.Render(nil); err != nil || output != "denied" {
+		t.Errorf("expected %q got %q, %v", "denied", output, err)
+	}
+}
+
+func TestStandardHelpers(t *testing.T) {
+	context := map[string]interface{}{
+		"admin":  true,
+		"guest":  false,
+		"name":   "Ann",
+		"items":  []string{"a", "b"},
+		"empty":  []string{},
+		"errors": 0,
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{#if admin}}yes{{else}}no{{/if}}`, "yes"},
+		{`{{#if guest}}yes{{else}}no{{/if}}`, "no"},
+		{`{{#if missing}}yes{{/if}}`, ""},
+		{`{{#if items}}{{#each items}}{{.}}{{/each}}{{else}}none{{/if}}`, "ab"},
+		{`{{#if empty}}{{.}}{{else}}none{{/if}}`, "none"},
+		{`{{#if admin}}{{name}}{{/if}}`, "Ann"},
+		{`{{#if admin}}{{#if guest}}both{{else}}admin{{/if}}{{else}}{{#if guest}}guest{{else}}nobody{{/if}}{{/if}}`, "admin"},
+		{`{{#unless errors}}ok{{else}}failed{{/unless}}`, "ok"},
+		{`{{#unless admin}}user{{else}}admin{{/unless}}`, "admin"},
+		{"<ul>\n{{#if guest}}\n  <li>guest</li>\n{{else}}\n  <li>{{name}}</li>\n{{/if}}\n</ul>", "<ul>\n  <li>Ann</li>\n</ul>"},
+		{`{{#admin}}{{else}}{{/admin}}`, ""},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithStandardHelpers().CompileString(test.tmpl)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+			continue
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	if _, err := New().WithStandardHelpers().CompileString(`{{#if a}}{{else}}{{else}}{{/if}}`); err == nil {
+		t.Error("expected an error for two else tags")
+	}
+	// without WithStandardHelpers, if is an ordinary name
+	tmpl, err := New().CompileString(`{{#if admin}}yes{{/if admin}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]bool{"if admin": true})
+	if err != nil || output != "yes" {
+		t.Errorf("expected %q got %q (%v)", "yes", output, err)
+	}
+}
+
+func TestBlockHelpers(t *testing.T) {
+	helpers := map[string]BlockHelperFn{
+		"repeat": func(args []interface{}, context interface{}, body, inverse BlockRenderFn) (string, error) {
+			n, ok := args[0].(int)
+			if !ok {
+				return "", fmt.Errorf("cannot repeat %v times", args[0])
+			}
+			if n == 0 {
+				return inverse()
+			}
+			var sb strings.Builder
+			for i := 0; i < n; i++ {
+				s, err := body(i)
+				if err != nil {
+					return "", err
+				}
+				sb.WriteString(s)
+			}
+			return sb.String(), nil
+		},
+		"eq": func(args []interface{}, context interface{}, body, inverse BlockRenderFn) (string, error) {
+			if len(args) == 2 && fmt.Sprint(args[0]) == fmt.Sprint(args[1]) {
+				return body()
+			}
+			return inverse()
+		},
+		"dump": func(args []interface{}, context interface{}, body, inverse BlockRenderFn) (string, error) {
+			return fmt.Sprintf("%d %v", len(args), context), nil
+		},
+	}
+	context := map[string]interface{}{"n": 3, "zero": 0, "lang": "fr", "title": "<T>"}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{#repeat n}}[{{.}} {{title}}]{{/repeat}}`, "[0 &lt;T&gt;][1 &lt;T&gt;][2 &lt;T&gt;]"},
+		{`{{#repeat zero}}x{{else}}never{{/repeat}}`, "never"},
+		{`{{#eq lang "fr"}}Bonjour{{else}}Hello{{/eq}}`, "Bonjour"},
+		{`{{#eq lang "de"}}Hallo{{else}}Hello{{/eq}}`, "Hello"},
+		{`{{#eq lang "fr"}}{{#repeat n}}{{#eq . "1"}}!{{else}}.{{/eq}}{{/repeat}}{{/eq}}`, ".!."},
+		{`{{#dump}}ignored{{/dump}}`, "0 map[lang:fr n:3 title:<T> zero:0]"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithBlockHelpers(helpers).CompileString(test.tmpl)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+			continue
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Errorf("%q: %v", test.tmpl, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithBlockHelpers(helpers).CompileString(`{{#repeat lang}}x{{/repeat}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(context); err == nil || err.Error() != "line 1: repeat: cannot repeat fr times" {
+		t.Errorf("expected the helper's error got %v", err)
+	}
+
+	// Registering helpers later doesn't change the templates already compiled.
+	compiler := New().WithBlockHelpers(helpers)
+	tmpl, err = compiler.CompileString(`{{#repeat n}}x{{/repeat}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler.WithBlockHelpers(map[string]BlockHelperFn{"repeat": helpers["dump"]})
+	if output, err := tmpl.Render(context); err != nil || output != "xxx" {
+		t.Errorf("expected %q got %q, %v", "xxx", output, err)
+	}
+}
+
+func TestSectionAs(t *testing.T) {
+	data := map[string]interface{}{
+		"users": []map[string]interface{}{
+			{"name": "Ann", "roles": []string{"admin", "dev"}},
+			{"name": "Bob", "roles": []string{"ops"}},
+		},
+		"owner": map[string]string{"name": "Cy", "owner": "shadowed"},
+		"name":  "outer",
+	}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{#users as user}}{{user.name}};{{/users}}", "Ann;Bob;"},
+		{"{{#users as user}}{{#user.roles as role}}{{user.name}}:{{role}} {{/user.roles}}{{/users}}",
+			"Ann:admin Ann:dev Bob:ops "},
+		// The element is still the context, and {{.}}.
+		{"{{#users as user}}{{name}}={{user.name}} {{/users}}", "Ann=Ann Bob=Bob "},
+		{"{{#users as u}}{{#u.roles as r}}{{.}}{{/u.roles}}{{/users}}", "admindevops"},
+		{"{{# users  as  u }}{{u.name}}{{/ users }}", "AnnBob"},
+		{"{{#owner as o}}{{o.name}}{{/owner}}", "Cy"},
+		// Names the value has take precedence over the bound name.
+		{"{{#owner as owner}}{{owner}}{{/owner}}", "shadowed"},
+		{"{{#each users as user}}{{@index}}{{user.name}}{{/each}}", "0Ann1Bob"},
+		{"{{#with owner as o}}{{o.name}}{{/with}}", "Cy"},
+		{"{{#missing as m}}{{m}}{{else}}none{{/missing}}", "none"},
+		{"{{#users as user}}{{/users}}{{user.name}}", ""},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.template)
+		if err != nil {
+			t.Errorf("%q: %v", test.template, err)
+			continue
+		}
+		output, err := tmpl.Render(data)
+		if err != nil {
+			t.Errorf("%q: %v", test.template, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.template, test.expected, output)
+		}
+	}
+
+	for _, template := range []string{
+		"{{^users as u}}{{/users}}",
+		"{{#users as 1u}}{{/users}}",
+		"{{#users as u.name}}{{/users}}",
+		"{{#if users as u}}{{/if}}",
+		"{{#define \"x\" as u}}{{/define}}",
+		"{{#a b as u}}{{/a}}",
+	} {
+		_, err := New().WithStandardHelpers().CompileString(template)
+		if err == nil || !strings.Contains(err.Error(), "as can only name") {
+			t.Errorf("%q: expected an error, got %v", template, err)
+		}
+	}
+
+	tmpl, err := New().CompileString("{{# users  as  u }}{{u.name}}{{/ users }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source, expected := tmpl.String(), "{{#users as u}}\n{{u.name}}{{/users}}"; source != expected {
+		t.Errorf("expected %q got %q", expected, source)
+	}
+	other, err := New().CompileString("{{#users as v}}{{u.name}}{{/users}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.Equal(other) {
+		t.Error("expected sections binding different names not to be equal")
+	}
+}
+
+func TestRenderSection(t *testing.T) {
+	tmpl, err := New().CompileString("<h1>{{title}}</h1>{{#content}}<ul>{{#items}}<li>{{name}}</li>{{/items}}</ul>" +
+		"{{/content}}{{#user.roles}}[{{.}}]{{/user.roles}}{{^items}}none{{/items}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path     string
+		data     interface{}
+		expected string
+	}{
+		{"content", map[string]interface{}{"items": []map[string]string{{"name": "a"}}}, "<ul><li>a</li></ul>"},
+		{"content.items", map[string]string{"name": "<b>"}, "<li>&lt;b&gt;</li>"},
+		{"user.roles", "admin", "[admin]"},
+		{"items", nil, "none"},
+	}
+	for _, test := range tests {
+		output, err := tmpl.RenderSection(test.path, test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+		} else if output != test.expected {
+			t.Errorf("%s: expected %q got %q", test.path, test.expected, output)
+		}
+	}
+
+	for _, path := range []string{"title", "items.name", "content.missing", "user", ""} {
+		if _, err := tmpl.RenderSection(path, nil); err == nil || err.Error() != fmt.Sprintf("no section %q in template", path) {
+			t.Errorf("%q: expected an unknown section error, got %v", path, err)
+		}
+	}
+}
+
+func TestDefine(t *testing.T) {
+	tmpl, err := New().CompileString(`{{#define "subject"}}Welcome, {{name}}!{{/define}}
+{{#define "body"}}
+<p>Hello {{name}},</p>
+{{#define "signature"}}
+<p>{{sender}}</p>
+{{/define}}
+{{/define}}
+{{name}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := map[string]string{"name": "Bob", "sender": "Alice"}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"subject", "Welcome, Bob!"},
+		{"body", "<p>Hello Bob,</p>\n"},
+		{"signature", "<p>Alice</p>\n"},
+	}
+	for _, test := range tests {
+		output, err := tmpl.RenderNamed(test.name, context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%s expected %q got %q", test.name, test.expected, output)
+		}
+	}
+	output, err := tmpl.Render(context)
+	if err != nil {
+		t.Error(err)
+	} else if output != "\nBob" {
+		t.Errorf("expected %q got %q", "\nBob", output)
+	}
+	if _, err := tmpl.RenderNamed("missing", context); err == nil {
+		t.Error("expected error rendering undefined template")
+	}
+
+	_, err = New().CompileString(`{{#define "a"}}{{/define}}{{#define "a"}}{{/define}}`)
+	if err == nil {
+		t.Error("expected error for duplicate define")
+	}
+}
+
+// testLogger writes the events logged with WithLogger in the format of log/slog's text handler, without the time.
+type testLogger struct {
+	w io.Writer
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) {
+	line := "level=DEBUG msg=" + logValue(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%s", args[i], logValue(fmt.Sprint(args[i+1])))
+	}
+	fmt.Fprintln(l.w, line)
+}
+
+// logValue quotes a value in a log line if it needs it, as log/slog's text handler does.
+func logValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func TestSequences(t *testing.T) {
+	var pulled []int
+	numbers := func(yield func(int) bool) {
+		for _, n := range []int{1, 2, 3} {
+			pulled = append(pulled, n)
+			if !yield(n) {
+				return
+			}
+		}
+	}
+	users := func(yield func(string, User) bool) {
+		for _, u := range []User{{"Ann", 1}, {"Bob", 2}, {"Cy", 3}} {
+			if !yield(strings.ToLower(u.Name), u) {
+				return
+			}
+		}
+	}
+	empty := func(yield func(int) bool) {}
+	context := map[string]interface{}{"numbers": numbers, "users": users, "empty": empty}
+	tests := []struct {
+		tmpl     string
+		expected string
+		pulled   int
+	}{
+		{`{{#numbers}}{{.}}{{@index}},{{/numbers}}`, "10,21,32,", 3},
+		{`{{#users}}{{@key}}={{Name}}:{{ID}},{{/users}}`, "ann=Ann:1,bob=Bob:2,cy=Cy:3,", 0},
+		{`{{#each numbers}}{{@value}}{{/each}}`, "123", 3},
+		{`{{^numbers}}none{{/numbers}}`, "", 1},
+		{`{{#empty}}x{{/empty}}{{^empty}}none{{/empty}}`, "none", 0},
+		{`{{#each empty}}x{{/each}}{{^each empty}}none{{/each}}`, "none", 0},
+	}
+	for _, test := range tests {
+		pulled = nil
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+		if len(pulled) != test.pulled {
+			t.Errorf("%q expected %d values pulled, got %d", test.tmpl, test.pulled, len(pulled))
+		}
+	}
+
+	// An error while rendering stops the sequence.
+	tmpl, err := New().WithErrors(true).CompileString(`{{#numbers}}{{.}}{{missing}}{{/numbers}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled = nil
+	if _, err := tmpl.Render(context); err == nil {
+		t.Error("expected error")
+	}
+	if len(pulled) != 1 {
+		t.Errorf("expected 1 value pulled, got %d", len(pulled))
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &testLogger{&buf}
+	tmpl, err := New().WithLogger(logger).WithPartials(&StrictStaticProvider{map[string]string{"p": "{{b}}"}}).
+		CompileString("{{=<% %>=}}<%a%><%>p%><%>q%><%#l%>x<%/l%>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tmpl.Render(map[string]interface{}{
+		"a": "a",
+		"l": func(text string, render RenderFn) (string, error) { return text, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`level=DEBUG msg="mustache: delimiters changed" line=1 open=<% close=%>`,
+		`level=DEBUG msg="mustache: partial" name=p provider=*mustache.StrictStaticProvider found=true error=<nil>`,
+		`level=DEBUG msg="mustache: missing variable" name=b`,
+		`level=DEBUG msg="mustache: partial" name=q provider=*mustache.StrictStaticProvider found=false error="q: partial not found"`,
+		`level=DEBUG msg="mustache: calling lambda" name=l`,
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d log lines, got %d:\n%s", len(expected), len(lines), buf.String())
+	}
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], line)
+		}
+	}
+}
+
+func TestFuncValues(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &testLogger{&buf}
+	var nilFunc func() string
+	context := map[string]interface{}{
+		"name":    func() string { return "<Ann>" },
+		"count":   func() (int, error) { return 3, nil },
+		"fail":    func() (string, error) { return "", errors.New("no name") },
+		"args":    func(s string) string { return s },
+		"none":    func() {},
+		"nilFunc": nilFunc,
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+		err      string
+	}{
+		{`{{name}} {{{name}}} {{count}}`, "&lt;Ann&gt; <Ann> 3", ""},
+		{`{{fail}}`, "", "fail: no name"},
+		{`[{{args}}][{{none}}][{{nilFunc}}]`, "[][][]", ""},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.HasSuffix(err.Error(), test.err)) {
+			t.Errorf("%q expected error %q got %v", test.tmpl, test.err, err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithErrors(true).WithLogger(logger).CompileString(`{{name}}{{args}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tmpl.Render(context)
+	if expected := "line 1: cannot call args of type func(string) string: it must take no arguments and return one " +
+		"value, or a value and an error"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q got %v", expected, err)
+	}
+	expected := []string{
+		`level=DEBUG msg="mustache: calling function" name=name type="func() string"`,
+		`level=DEBUG msg="mustache: not calling function" name=args type="func(string) string"`,
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected log lines %q got %q", expected, lines)
+	}
+}
+
+func benchmarkRender(b *testing.B, cmpl *Compiler) {
+	tmpl, err := cmpl.CompileString(`{{#users}}{{Name}} {{missing}}{{/users}}`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	context := map[string]interface{}{"users": makeVector(10)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tmpl.Frender(io.Discard, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseCache(t *testing.T) {
+	cmpl := New().WithParseCache(true)
+	first, err := cmpl.CompileString("Hello, {{name}}!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cmpl.CompileString("Hello, {{name}}!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected the second compile of the same source to return the cached template")
+	}
+	if other, _ := cmpl.CompileString("Bye, {{name}}!"); other == first {
+		t.Error("expected different source to give a different template")
+	}
+	if uncached, _ := New().CompileString("Hello, {{name}}!"); uncached == first {
+		t.Error("expected no caching without WithParseCache")
+	}
+
+	// Templates which fail to compile are not cached.
+	if _, err := cmpl.CompileString("{{#a}}"); err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := cmpl.CompileString("{{#a}}"); err == nil {
+		t.Error("expected an error the second time too")
+	}
+
+	// Setting an option empties the cache, so the template is compiled again with it.
+	cmpl = New().WithParseCache(true)
+	html, err := cmpl.CompileString("{{a}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := cmpl.WithEscapeMode(Raw).CompileString("{{a}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw == html {
+		t.Error("expected a new template after changing the escape mode")
+	}
+	if output, _ := raw.Render(map[string]string{"a": "<b>"}); output != "<b>" {
+		t.Errorf("expected %q got %q", "<b>", output)
+	}
+	strict, err := cmpl.WithErrors(true).CompileString("{{a}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.Render(nil); err == nil {
+		t.Error("expected an error for a missing variable after setting WithErrors")
+	}
+	if again, _ := cmpl.CompileString("{{a}}"); again != strict {
+		t.Error("expected the template to be cached again once the options are unchanged")
+	}
+
+	// The least recently used template is dropped once the cache is full.
+	cmpl = New().WithParseCache(true).WithParseCacheSize(2)
+	a, _ := cmpl.CompileString("a")
+	b, _ := cmpl.CompileString("b")
+	if again, _ := cmpl.CompileString("a"); again != a {
+		t.Error("expected a to be cached")
+	}
+	cmpl.CompileString("c")
+	if again, _ := cmpl.CompileString("a"); again != a {
+		t.Error("expected a to be kept, as it was used more recently than b")
+	}
+	if again, _ := cmpl.CompileString("b"); again == b {
+		t.Error("expected b to have been dropped")
+	}
+
+	// Templates compiled from files, which are given their names, are not shared.
+	fsys := fstest.MapFS{"one.mustache": {Data: []byte("{{@template.name}}")}, "two.mustache": {Data: []byte("{{@template.name}}")}}
+	cmpl = New().WithParseCache(true)
+	for _, name := range []string{"one.mustache", "two.mustache"} {
+		tmpl, err := cmpl.CompileFS(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output, err := tmpl.Render(nil); err != nil || output != name {
+			t.Errorf("expected %q got %q (%v)", name, output, err)
+		}
+	}
+
+	// A cached template can be compiled and rendered from several goroutines at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tmpl, err := cmpl.CompileString("{{#items}}{{.}}{{/items}}")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if output, err := tmpl.Render(map[string][]int{"items": {i, i}}); err != nil || output != fmt.Sprintf("%d%d", i, i) {
+				t.Errorf("expected %d%d got %q (%v)", i, i, output, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestParseCacheOptions sets options on a compiler while templates it has cached render, which the race detector
+// checks doesn't touch anything the templates use.
+func TestParseCacheOptions(t *testing.T) {
+	sp := &StaticProvider{map[string]string{"greeting": "{{#loud}}{{upper name}}{{/loud}}"}}
+	funcs := template.FuncMap{"upper": strings.ToUpper}
+	cmpl := New().WithParseCache(true).WithPartials(sp).WithFuncs(funcs).WithBlockHelpers(map[string]BlockHelperFn{
+		"loud": func(args []interface{}, context interface{}, body, inverse BlockRenderFn) (string, error) {
+			s, err := body()
+			return s + "!", err
+		},
+	})
+	tmpl, err := cmpl.CompileString("{{>greeting}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if output, err := tmpl.Render(map[string]string{"name": "ann"}); err != nil || output != "ANN!" {
+					t.Errorf("expected %q got %q (%v)", "ANN!", output, err)
+					return
+				}
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		cmpl.WithFuncs(template.FuncMap{"upper": strings.ToLower}).
+			WithBlockHelpers(map[string]BlockHelperFn{"loud": nil}).
+			WithPartials(&StaticProvider{}).
+			WithEscapeMode(Raw)
+	}
+	wg.Wait()
+	if again, _ := cmpl.CompileString("{{>greeting}}"); again == tmpl {
+		t.Error("expected the cache to have been emptied")
+	}
+}
+
+// BenchmarkCompileCached compiles the same source repeatedly with the parse cache, which after the first compile only
+// looks the template up; compare with BenchmarkCompile.
+func BenchmarkCompileCached(b *testing.B) {
+	benchmarkCompile(b, New().WithParseCache(true))
+}
+
+func BenchmarkCompile(b *testing.B) {
+	benchmarkCompile(b, New())
+}
+
+func benchmarkCompile(b *testing.B, cmpl *Compiler) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := cmpl.CompileString(`<ul>{{#users}}<li>{{Name}} {{{Bio}}}</li>{{/users}}</ul>{{> footer}}`); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRender renders without a logger, which must add no overhead; compare with BenchmarkRenderLogger, where
+// debug events are prepared and then discarded by the handler.
+func BenchmarkRender(b *testing.B) {
+	benchmarkRender(b, New())
+}
+
+func benchmarkBuilder(b *testing.B, render func(tmpl *Template, sb *strings.Builder, context interface{}) error) {
+	tmpl, err := New().CompileString(`<ul>{{#users}}<li>{{Name}}</li>{{/users}}</ul>`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	context := map[string]interface{}{"users": makeVector(10)}
+	var sb strings.Builder
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sb.Reset()
+		sb.WriteString("<body>")
+		if err := render(tmpl, &sb, context); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFrenderBuilder renders into a strings.Builder, which should allocate less than BenchmarkRenderWriteString,
+// which renders to a string and then copies it into the builder.
+func BenchmarkFrenderBuilder(b *testing.B) {
+	benchmarkBuilder(b, func(tmpl *Template, sb *strings.Builder, context interface{}) error {
+		return tmpl.Frender(sb, context)
+	})
+}
+
+func BenchmarkRenderWriteString(b *testing.B) {
+	benchmarkBuilder(b, func(tmpl *Template, sb *strings.Builder, context interface{}) error {
+		s, err := tmpl.Render(context)
+		sb.WriteString(s)
+		return err
+	})
+}
+
+func TestFrenderBuilder(t *testing.T) {
+	tmpl, err := New().CompileString(`<b>{{name}}</b>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	sb.WriteString("<p>")
+	if err := tmpl.Frender(&sb, map[string]string{"name": "a&b"}); err != nil {
+		t.Fatal(err)
+	}
+	sb.WriteString("</p>")
+	if expected := "<p><b>a&amp;b</b></p>"; sb.String() != expected {
+		t.Errorf("expected %q got %q", expected, sb.String())
+	}
+}
+
+type Address struct {
+	Street string
+	City   string
+}
+
+type Contact struct {
+	Name string
+	Address
+	secret string
+	Phone  string
+	City   string
+}
+
+func TestFields(t *testing.T) {
+	contact := Contact{"Mike", Address{"Main St", "Springfield"}, "shh", "555-1234", "Shelbyville"}
+	tests := []Test{
+		{`{{#fields user}}{{@index}}:{{@key}}={{@value}};{{/fields}}`, map[string]interface{}{"user": User{"Mike", 1}}, "0:Name=Mike;1:ID=1;", nil},
+		{`{{#fields user}}{{@key}}={{.}};{{/fields}}`, map[string]interface{}{"user": &User{"Mike", 1}}, "Name=Mike;ID=1;", nil},
+		// embedded fields are promoted, unless shadowed, and unexported fields are skipped
+		{`{{#fields c}}{{@key}}={{.}};{{/fields}}`, map[string]interface{}{"c": contact}, "Name=Mike;Street=Main St;Phone=555-1234;City=Shelbyville;", nil},
+		{`{{#fields .}}{{@key}} {{/fields}}`, Address{}, "Street City ", nil},
+		// anything other than a struct has no fields
+		{`{{#fields m}}{{@key}}{{/fields}}`, map[string]interface{}{"m": map[string]string{"a": "b"}}, "", nil},
+		{`{{^fields m}}none{{/fields}}`, map[string]interface{}{"m": "string"}, "none", nil},
+		{`{{^fields m}}none{{/fields}}`, map[string]interface{}{"m": struct{ x int }{1}}, "none", nil},
+		{`{{^fields m}}none{{/fields}}`, map[string]interface{}{"m": User{}}, "", nil},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		output, err := tmpl.Render(test.context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+type LayoutTest struct {
+	layout   string
+	tmpl     string
+	context  interface{}
+	expected string
+}
+
+var layoutTests = []LayoutTest{
+	{`Header {{content}} Footer`, `Hello World`, nil, `Header Hello World Footer`},
+	{`Header {{content}} Footer`, `Hello {{s}}`, map[string]string{"s": "World"}, `Header Hello World Footer`},
+	{`Header {{content}} Footer`, `Hello {{content}}`, map[string]string{"content": "World"}, `Header Hello World Footer`},
+	{`Header {{extra}} {{content}} Footer`, `Hello {{content}}`, map[string]string{"content": "World", "extra": "extra"}, `Header extra Hello World Footer`},
+	{`Header {{content}} {{content}} Footer`, `Hello {{content}}`, map[string]string{"content": "World"}, `Header Hello World Hello World Footer`},
+}
+
+func TestLayout(t *testing.T) {
+	for _, test := range layoutTests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Error(err)
+		}
+		tmpl2, err := New().CompileString(test.layout)
+		if err != nil {
+			t.Error(err)
+		}
+		output, err := tmpl.RenderInLayout(tmpl2, test.context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestLayoutToWriter(t *testing.T) {
+	for _, test := range layoutTests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		layoutTmpl, err := New().CompileString(test.layout)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var buf bytes.Buffer
+		err = tmpl.FRenderInLayout(&buf, layoutTmpl, test.context)
+		if err != nil {
+			t.Error(err)
+		} else if buf.String() != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, buf.String())
+		}
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	tmpl, err := New().CompileString(`<p>{{title}}</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := New().CompileString(`<section>{{{content}}}</section>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := New().CompileString(`<html><title>{{title}}</title>{{{content}}}</html>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := map[string]string{"title": "Home"}
+	tests := []struct {
+		layouts  []*Template
+		expected string
+	}{
+		{nil, `<p>Home</p>`},
+		{[]*Template{section}, `<section><p>Home</p></section>`},
+		{[]*Template{section, base}, `<html><title>Home</title><section><p>Home</p></section></html>`},
+	}
+	for _, test := range tests {
+		output, err := tmpl.RenderInLayouts(test.layouts, context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("expected %q got %q", test.expected, output)
+		}
+		var buf bytes.Buffer
+		err = tmpl.FRenderInLayouts(&buf, test.layouts, context)
+		if err != nil {
+			t.Error(err)
+		} else if buf.String() != test.expected {
+			t.Errorf("expected %q got %q", test.expected, buf.String())
+		}
+	}
+}
+
+func TestLayoutSlot(t *testing.T) {
+	tmpl, err := New().CompileString(`<p>{{content}}</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := New().WithLayoutSlot("__body__").CompileString(`<div>{{content}}</div>{{{__body__}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.RenderInLayout(layout, map[string]string{"content": "Lorem ipsum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<div>Lorem ipsum</div><p>Lorem ipsum</p>`
+	if output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+}
+
+type userRecord struct {
+	First, Last string
+	Email       string
+}
+
+type userView struct {
+	user *userRecord
+}
+
+func (v *userView) FullName() string {
+	return v.user.First + " " + v.user.Last
+}
+
+func (v *userView) MustacheContext() interface{} {
+	return v.user
+}
+
+type pageView struct {
+	data map[string]interface{}
+}
+
+func (v pageView) Title() string {
+	return strings.ToUpper(v.data["title"].(string))
+}
+
+func (v pageView) MustacheContext() interface{} {
+	return v.data
+}
+
+type resolverPerson struct {
+	FirstName string
+	LastName  string
+	Address   struct{ PostCode string }
+}
+
+func (p resolverPerson) FullName() string {
+	return p.FirstName + " " + p.LastName
+}
+
+// snakeCase resolves snake_case names to the CamelCase fields of structs.
+func snakeCase(context interface{}, name string) (interface{}, bool) {
+	v := reflect.Indirect(reflect.ValueOf(context))
+	if v.Kind() != reflect.Struct || !strings.Contains(name, "_") {
+		return nil, false
+	}
+	var field string
+	for _, word := range strings.Split(name, "_") {
+		if word != "" {
+			field += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	if f := v.FieldByName(field); f.IsValid() {
+		return f.Interface(), true
+	}
+	return nil, false
+}
+
+func TestNameResolver(t *testing.T) {
+	person := resolverPerson{FirstName: "Ann", LastName: "Lee"}
+	person.Address.PostCode = "AB1"
+	tests := []struct {
+		template string
+		data     interface{}
+		expected string
+	}{
+		{"{{first_name}} {{last_name}}", person, "Ann Lee"},
+		{"{{first_name}} {{last_name}}", &person, "Ann Lee"},
+		// Names the resolver doesn't have are looked up as usual.
+		{"{{FirstName}} {{FullName}} {{missing_name}}", person, "Ann Ann Lee "},
+		{"{{Address.post_code}}", person, "AB1"},
+		{"{{#people}}{{first_name}},{{/people}}", map[string]interface{}{"people": []resolverPerson{person, {FirstName: "Bo"}}},
+			"Ann,Bo,"},
+		// Values further out in the context are resolved too.
+		{"{{#Other}}{{first_name}}{{/Other}}", struct {
+			Other     map[string]int
+			FirstName string
+		}{map[string]int{"x": 1}, "Cy"}, "Cy"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithNameResolver(snakeCase).CompileString(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(test.data)
+		if err != nil {
+			t.Errorf("%q: %v", test.template, err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.template, test.expected, output)
+		}
+	}
+
+	// The resolver is asked before the built-in lookup, and a nil value it returns is found but empty.
+	tmpl, err := New().WithErrors(true).WithNameResolver(func(context interface{}, name string) (interface{}, bool) {
+		switch name {
+		case "a":
+			return "resolved", true
+		case "b":
+			return nil, true
+		}
+		return nil, false
+	}).CompileString("{{a}} [{{b}}] {{c}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := tmpl.Render(map[string]string{"a": "map", "b": "map", "c": "map"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "resolved [] map"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+}
+
+func TestCollectMissing(t *testing.T) {
+	partials := &StaticProvider{map[string]string{"p": "<{{inner}}>"}}
+	data := map[string]interface{}{"name": "Ann", "items": []int{1, 2}}
+	for _, errorOnMissing := range []bool{false, true} {
+		tmpl, err := New().WithErrors(errorOnMissing).WithCollectMissing(true).WithPartials(partials).
+			CompileString("{{name}} {{first}}\n{{#items}}{{.}}{{second}}{{/items}} {{>p}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(data)
+		if expected := "Ann \n12 <>"; output != expected {
+			t.Errorf("WithErrors(%t): expected %q got %q", errorOnMissing, expected, output)
+		}
 		if err == nil {
-			t.Error(err)
+			t.Fatalf("WithErrors(%t): expected an error", errorOnMissing)
+		}
+		expected := "line 1: missing variable \"first\"\nline 2: missing variable \"second\"\n" +
+			"p: line 1: missing variable \"inner\""
+		if err.Error() != expected {
+			t.Errorf("WithErrors(%t): expected error %q got %q", errorOnMissing, expected, err)
+		}
+		var re *RenderError
+		if !errors.As(err, &re) || re.Line != 1 {
+			t.Errorf("WithErrors(%t): expected a *RenderError, got %#v", errorOnMissing, err)
 		}
 	}
-}
 
-/*
-func TestSectionPartial(t *testing.T) {
-    filename := path.Join(path.Join(os.Getenv("PWD"), "tests"), "test3.mustache")
-    expected := "Mike\nJoe\n"
-    context := map[string]interface{}{"users": []User{{"Mike", 1}, {"Joe", 2}}}
-    output := RenderFile(filename, context)
-    if output != expected {
-        t.Fatalf("testSectionPartial expected %q got %q", expected, output)
-    }
-}
-*/
-func TestMultiContext(t *testing.T) {
-	tmpl, err := New().CompileString(`{{hello}} {{World}}`)
+	// A missing section still stops the render, and is returned after the missing variables found before them.
+	tmpl, err := New().WithErrors(true).WithCollectMissing(true).CompileString("{{a}}{{#b}}{{/b}}{{c}}")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	output, err := tmpl.Render(map[string]string{"hello": "hello"}, struct{ World string }{"world"})
-	if err != nil {
-		t.Error(err)
+	_, err = tmpl.Render(nil)
+	if expected := "line 1: missing variable \"a\"\nline 1: missing variable \"b\""; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q got %v", expected, err)
 	}
-	tmpl2, err := New().CompileString(`{{hello}} {{World}}`)
+
+	// Without missing variables, there is no error.
+	tmpl, err = New().WithCollectMissing(true).CompileString("{{name}}")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	output2, err := tmpl2.Render(struct{ World string }{"world"}, map[string]string{"hello": "hello"})
-	if err != nil {
+	if _, err := tmpl.Render(data); err != nil {
 		t.Error(err)
 	}
-	if output != "hello world" || output2 != "hello world" {
-		t.Errorf("TestMultiContext expected %q got %q", "hello world", output)
-	}
 }
 
-func lambda(text string, render RenderFn, res string, data map[string]interface{}) (string, error) {
-	d, err := render(text)
-	data[res] = d
-	if err == nil {
-		return "OK", nil
+func TestDynamicContext(t *testing.T) {
+	calls := map[string]int{}
+	data := map[string]interface{}{
+		"name":  "Ann",
+		"user":  map[string]string{"email": "ann@example.com"},
+		"items": []int{1, 2},
+		"none":  nil,
 	}
-	return "", err
-}
-
-func TestLambda(t *testing.T) {
-	templ := `Call:{{#lambda}}hello {{lookup}} {{#sub}}{{.}} {{/sub}}{{^negsub}}nothing{{/negsub}}{{/lambda}};Result:{{result}}`
-	data := make(map[string]interface{})
-	data["lookup"] = "world"
-	data["sub"] = []string{"subv1", "subv2"}
-	data["negsub"] = nil
-	data["lambda"] = func(text string, render RenderFn) (string, error) {
-		return lambda(text, render, "result", data)
+	fn := func(name string) (interface{}, bool) {
+		calls[name]++
+		v, ok := data[name]
+		return v, ok
 	}
-	tmpl, err := New().CompileString(templ)
+	tmpl, err := New().CompileString("{{name}} {{name}} {{user.email}} {{#items}}{{.}}{{name}}{{/items}}[{{none}}]{{other}}")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	output, _ := tmpl.Render(templ, data)
-	expect := "Call:OK;Result:hello world subv1 subv2 nothing"
-	if output != expect {
-		t.Fatalf("TestMultiContext expected %q got %q", expect, output)
+	output, err := tmpl.Render(fn, map[string]string{"other": "!", "unused": "?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Ann Ann ann@example.com 1Ann2Ann[]!"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	expected := map[string]int{"name": 1, "user": 1, "items": 1, "none": 1, "other": 1}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v got %v", expected, calls)
 	}
-}
 
-func TestLambdaError(t *testing.T) {
-	templ := `stop_at_error.{{#lambda}}{{/lambda}}.never_here`
-	data := make(map[string]interface{})
-	data["lambda"] = func(text string, render RenderFn) (string, error) {
-		return "", fmt.Errorf("test err")
+	// The results are kept only for the render.
+	if _, err := tmpl.Render(DynamicContext(fn)); err != nil {
+		t.Fatal(err)
 	}
-	tmpl, err := New().CompileString(templ)
+	if calls["name"] != 2 {
+		t.Errorf("expected name to be looked up again in a new render, got %d calls", calls["name"])
+	}
+
+	tmpl, err = New().WithErrors(true).CompileString("{{missing}}")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	output, _ := tmpl.Render(data)
-	expect := "stop_at_error."
-	if output != expect {
-		t.Fatalf("TestLambdaError expected %q got %q", expect, output)
+	if _, err := tmpl.Render(fn); err == nil || err.Error() != `line 1: missing variable "missing"` {
+		t.Errorf("expected a missing variable error, got %v", err)
 	}
 }
 
-var malformed = []Test{
-	{`{{#a}}{{}}{{/a}}`, Data{true, "hello"}, "", fmt.Errorf("line 1: empty tag")},
-	{`{{}}`, nil, "", fmt.Errorf("line 1: empty tag")},
-	{`{{}`, nil, "", fmt.Errorf("line 1: unmatched open tag")},
-	{`{{`, nil, "", fmt.Errorf("line 1: unmatched open tag")},
-	// invalid syntax - https://github.com/hoisie/mustache/issues/10
-	{`{{#a}}{{#b}}{{/a}}{{/b}}}`, map[string]interface{}{}, "", fmt.Errorf("line 1: interleaved closing tag: a")},
-}
-
-func TestMalformed(t *testing.T) {
-	for _, test := range malformed {
-		tmpl, err := New().CompileString(test.tmpl)
-		var output string
-		if err == nil {
-			output, err = tmpl.Render(test.context)
+func TestContextNamespace(t *testing.T) {
+	type person struct {
+		Name string
+	}
+	ctx := map[string]interface{}{"name": "Ann", "flags": map[string]bool{"beta": true}}
+	record := map[string]interface{}{"name": "Invoice 7", "@ctx": "shadow", "items": []person{{"x"}, {"y"}}}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{name}} for {{@ctx.name}}`, "Invoice 7 for Ann"},
+		{`{{#items}}{{Name}}:{{@ctx.name}} {{/items}}`, "x:Ann y:Ann "},
+		{`{{#@ctx.flags.beta}}beta{{/@ctx.flags.beta}}{{^@ctx.flags.alpha}} no alpha{{/@ctx.flags.alpha}}`, "beta no alpha"},
+		{`{{#@ctx}}{{name}}{{/@ctx}}`, "Ann"},
+		{`[{{@ctx.missing}}]`, "[]"},
+		{`{{@user.Name}}`, "Bob"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().WithContextNamespace("ctx", ctx).WithContextNamespace("@user", &person{"Bob"}).
+			CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
 		}
+		output, err := tmpl.Render(record)
 		if err != nil {
-			if test.err == nil {
-				t.Error(err)
-			} else if test.err.Error() != err.Error() {
-				t.Errorf("%q expected error %q but got error %q", test.tmpl, test.err.Error(), err.Error())
-			}
-		} else {
-			if test.err == nil {
-				t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
-			} else {
-				t.Errorf("%q expected error %q but got %q", test.tmpl, test.err.Error(), output)
-			}
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
 		}
 	}
-}
 
-type LayoutTest struct {
-	layout   string
-	tmpl     string
-	context  interface{}
-	expected string
+	// Setting a namespace later doesn't change the templates already compiled.
+	compiler := New().WithContextNamespace("ctx", ctx)
+	tmpl, err := compiler.CompileString(`{{@ctx.name}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler.WithContextNamespace("ctx", record)
+	if output, err := tmpl.Render(record); err != nil || output != "Ann" {
+		t.Errorf("expected %q got %q, %v", "Ann", output, err)
+	}
 }
 
-var layoutTests = []LayoutTest{
-	{`Header {{content}} Footer`, `Hello World`, nil, `Header Hello World Footer`},
-	{`Header {{content}} Footer`, `Hello {{s}}`, map[string]string{"s": "World"}, `Header Hello World Footer`},
-	{`Header {{content}} Footer`, `Hello {{content}}`, map[string]string{"content": "World"}, `Header Hello World Footer`},
-	{`Header {{extra}} {{content}} Footer`, `Hello {{content}}`, map[string]string{"content": "World", "extra": "extra"}, `Header extra Hello World Footer`},
-	{`Header {{content}} {{content}} Footer`, `Hello {{content}}`, map[string]string{"content": "World"}, `Header Hello World Hello World Footer`},
+func TestConstants(t *testing.T) {
+	constants := map[string]string{"gitSHA": "abc123"}
+	compiler := New().WithErrors(true).WithConstants(constants).WithConstants(map[string]string{"built": "today"})
+	tmpl, err := compiler.CompileString("{{@const.gitSHA}} {{gitSHA}} {{@const.built}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	constants["gitSHA"] = "changed"
+	compiler.WithConstants(map[string]string{"built": "tomorrow"})
+	data := map[string]interface{}{"gitSHA": "data", "@const": map[string]string{"gitSHA": "data", "built": "data"}}
+	output, err := tmpl.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "abc123 data today"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+
+	tmpl, err = New().WithErrors(true).WithConstants(constants).CompileString("{{@const.other}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(map[string]string{"other": "data"}); err == nil {
+		t.Error("expected an error for a missing constant")
+	}
 }
 
-func TestLayout(t *testing.T) {
-	for _, test := range layoutTests {
+func TestViewModel(t *testing.T) {
+	user := &userView{&userRecord{First: "Ann", Last: "Lee", Email: "ann@example.com"}}
+	page := pageView{map[string]interface{}{"title": "home", "user": user, "footer": "bye"}}
+	tests := []struct {
+		context  interface{}
+		tmpl     string
+		expected string
+	}{
+		{user, `{{FullName}} <{{Email}}>`, "Ann Lee <ann@example.com>"},
+		{page, `{{Title}} {{title}}`, "HOME home"},
+		{page, `{{#user}}{{FullName}} {{First}} {{title}}{{/user}}`, "Ann Lee Ann home"},
+		{page, `{{user.FullName}} {{user.Last}}`, "Ann Lee Lee"},
+		{page, `[{{missing}}]`, "[]"},
+	}
+	for _, test := range tests {
 		tmpl, err := New().CompileString(test.tmpl)
 		if err != nil {
-			t.Error(err)
-		}
-		tmpl2, err := New().CompileString(test.layout)
-		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		output, err := tmpl.RenderInLayout(tmpl2, test.context)
+		output, err := tmpl.Render(test.context)
 		if err != nil {
-			t.Error(err)
+			t.Errorf("%q: %v", test.tmpl, err)
 		} else if output != test.expected {
-			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+			t.Errorf("%q: expected %q got %q", test.tmpl, test.expected, output)
 		}
 	}
 }
 
-func TestLayoutToWriter(t *testing.T) {
-	for _, test := range layoutTests {
+func TestPointerChains(t *testing.T) {
+	user := &User{"Mike", 1}
+	users := &[]User{{"Ann", 2}, {"Bob", 3}}
+	var anyUsers interface{} = users
+	var nilUser *User
+	var nilAny interface{} = nilUser
+	tests := []struct {
+		tmpl     string
+		context  interface{}
+		expected string
+	}{
+		{`{{Name}} {{Func1}} {{Func2}}`, &user, "Mike Mike Mike"},
+		{`{{#users}}{{Name}},{{/users}}`, map[string]interface{}{"users": users}, "Ann,Bob,"},
+		{`{{#users}}{{Name}},{{/users}}`, map[string]*interface{}{"users": &anyUsers}, "Ann,Bob,"},
+		{`{{#each users}}{{@index}}{{Name}}{{/each}}`, map[string]*interface{}{"users": &anyUsers}, "0Ann1Bob"},
+		{`{{#user}}{{Name}}{{/user}}{{^user}}none{{/user}}`, map[string]interface{}{"user": &nilUser}, "none"},
+		{`{{#user}}{{Name}}{{/user}}{{^user}}none{{/user}}`, map[string]*interface{}{"user": &nilAny}, "none"},
+		{`[{{Name}}{{Func1}}{{Func2}}]`, nilUser, "[]"},
+		{`[{{user.Name}}{{user.Func2}}]`, map[string]interface{}{"user": &nilUser}, "[]"},
+	}
+	for _, test := range tests {
 		tmpl, err := New().CompileString(test.tmpl)
 		if err != nil {
-			t.Error(err)
-			continue
-		}
-		layoutTmpl, err := New().CompileString(test.layout)
-		if err != nil {
-			t.Error(err)
-			continue
+			t.Fatal(err)
 		}
-		var buf bytes.Buffer
-		err = tmpl.FRenderInLayout(&buf, layoutTmpl, test.context)
+		output, err := tmpl.Render(test.context)
 		if err != nil {
 			t.Error(err)
-		} else if buf.String() != test.expected {
-			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, buf.String())
+		} else if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
 		}
 	}
 }
@@ -742,6 +4883,100 @@ func TestPointerReceiver(t *testing.T) {
 	}
 }
 
+type profile struct {
+	First, Last string
+}
+
+func (p profile) DisplayName() string {
+	return p.First + " " + p.Last
+}
+
+func (p *profile) Initials() string {
+	return p.First[:1] + p.Last[:1]
+}
+
+type account struct {
+	profile profile
+}
+
+func (a account) Profile() profile {
+	return a.profile
+}
+
+func (a *account) ProfilePtr() *profile {
+	return &a.profile
+}
+
+func TestDottedMethods(t *testing.T) {
+	user := account{profile{"John", "Smith"}}
+	tests := []struct {
+		tmpl     string
+		context  interface{}
+		expected string
+	}{
+		{"{{user.Profile.DisplayName}}", map[string]interface{}{"user": user}, "John Smith"},
+		{"{{user.Profile.Initials}}", map[string]interface{}{"user": user}, "JS"},
+		{"{{user.Profile.First}}", map[string]interface{}{"user": &user}, "John"},
+		{"{{user.ProfilePtr.Initials}}", map[string]interface{}{"user": &user}, "JS"},
+		{"{{#user.Profile}}{{DisplayName}} {{Initials}}{{/user.Profile}}", map[string]interface{}{"user": user}, "John Smith JS"},
+		// elements of a slice are addressable, as in Go
+		{"{{#people}}{{Name1}};{{/people}}", map[string]interface{}{"people": []Person{{"John", "Smith"}}}, "John Smith;"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(test.context)
+		if err != nil {
+			t.Error(err)
+		} else if output != test.expected {
+			t.Errorf("%q: expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+}
+
+func TestDottedIndex(t *testing.T) {
+	type point struct{ X, Y int }
+	context := map[string]interface{}{
+		"coords": []float64{51.5, -0.12},
+		"points": [2]point{{1, 2}, {3, 4}},
+		"rows":   [][]string{{"a", "b"}, {"c"}},
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{`{{coords.0}},{{coords.1}}`, "51.5,-0.12"},
+		{`{{points.1.X}}/{{points.0.Y}}`, "3/2"},
+		{`{{rows.1.0}}{{rows.0.1}}`, "cb"},
+		{`[{{coords.2}}][{{coords.-1}}][{{coords.+1}}][{{rows.1.1}}]`, "[][][][]"},
+		{`{{#coords.5}}yes{{/coords.5}}{{^coords.5}}no{{/coords.5}}`, "no"},
+		{`{{#points.0}}{{X}}{{/points.0}}`, "1"},
+	}
+	for _, test := range tests {
+		tmpl, err := New().CompileString(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := tmpl.Render(context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.expected {
+			t.Errorf("%q expected %q got %q", test.tmpl, test.expected, output)
+		}
+	}
+
+	tmpl, err := New().WithErrors(true).CompileString(`{{coords.2}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(context); err == nil {
+		t.Error("expected an out of range index to be a missing variable")
+	}
+}
+
 type tag struct {
 	Type TagType
 	Name string
@@ -758,6 +4993,33 @@ var tagTests = []tagsTest{
 		tmpl: `hello world`,
 		tags: nil,
 	},
+	{
+		tmpl: `{{a}}{{=<% %>=}}<%#b%><%={{ }}=%>{{c}}{{/b}}`,
+		tags: []tag{
+			{
+				Type: Variable,
+				Name: "a",
+			},
+			{
+				Type: SetDelimiter,
+				Name: "<% %>",
+			},
+			{
+				Type: Section,
+				Name: "b",
+				Tags: []tag{
+					{
+						Type: SetDelimiter,
+						Name: "{{ }}",
+					},
+					{
+						Type: Variable,
+						Name: "c",
+					},
+				},
+			},
+		},
+	},
 	{
 		tmpl: `hello {{name}}`,
 		tags: []tag{
@@ -834,6 +5096,11 @@ func compareTags(t *testing.T, actual []Tag, expected []tag) {
 			compareTags(t, tag.Tags(), expected[i].Tags)
 		case Partial:
 			compareTags(t, tag.Tags(), expected[i].Tags)
+		case SetDelimiter:
+			if len(expected[i].Tags) != 0 {
+				t.Errorf("expected %d tags, got 0", len(expected[i].Tags))
+				return
+			}
 		case Invalid:
 			t.Errorf("invalid tag type: %s", tag.Type())
 			return
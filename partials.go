@@ -3,36 +3,89 @@ package mustache
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
+// ErrPartialNotFound is returned (possibly wrapped) by a PartialProvider when it has no partial with the requested
+// name.
+var ErrPartialNotFound = errors.New("partial not found")
+
 // PartialProvider comprises the behaviors required of a struct to be able to provide partials to the mustache rendering
 // engine.
 type PartialProvider interface {
-	// Get accepts the name of a partial and returns the parsed partial, if it could be found; a valid but empty
-	// template, if it could not be found; or nil and error if an error occurred (other than an inability to find
-	// the partial).
+	// Get accepts the name of a partial and returns the partial's source, if it could be found; an error wrapping
+	// ErrPartialNotFound, or an empty source as StaticProvider gives, if it could not be found; or some other error
+	// if the partial could not be read.
 	Get(name string) (string, error)
 }
 
+// RelativePartialProvider is implemented by a PartialProvider which can resolve the names of partials relative to the
+// template which includes them.
+type RelativePartialProvider interface {
+	PartialProvider
+	// GetRelative is like Get, but is also given the name of the including template: the name of the file it was
+	// compiled from, the name returned by an earlier call to GetRelative, or "" if it has no name. It returns the
+	// partial's source and the name by which partials included from it should refer to it.
+	GetRelative(from, name string) (string, string, error)
+}
+
 // FileProvider implements the PartialProvider interface by providing partials drawn from a filesystem. When a partial
 // named `NAME`  is requested, FileProvider searches each listed path for a file named as `NAME` followed by any of the
 // listed extensions. The default for `Paths` is to search the current working directory. The default for `Extensions`
 // is to examine, in order, no extension; then ".mustache"; then ".stache". If Unsafe is set, partial names are allowed
 // to begin with '.' or '..' after cleaning, meaning they can potentially refer to files outside any of the listed
-// directory paths.
+// directory paths. If FS is set, files are opened from it rather than from the operating system's filesystem, and
+// `Paths` are interpreted as slash-separated paths within it.
+//
+// If Relative is set, partials included by a template compiled from a file, or by another partial, are instead looked
+// for relative to the directory containing that file, and their names may use '..'. Unless Unsafe is also set, the
+// resulting path must be inside one of the listed paths.
+//
+// The error for a partial which can't be found lists the files that were tried, in the order they were tried.
 type FileProvider struct {
 	Paths      []string
 	Extensions []string
 	Unsafe     bool
+	FS         fs.FS
+	Relative   bool
 }
 
 // Get accepts the name of a partial and returns the parsed partial.
 func (fp *FileProvider) Get(name string) (string, error) {
+	data, _, err := fp.get(name)
+	return data, err
+}
+
+// GetRelative accepts the name of the template including a partial and the name of the partial, and returns the
+// partial along with the path it was read from. Names are only resolved relative to the including template if
+// Relative is set.
+func (fp *FileProvider) GetRelative(from, name string) (string, string, error) {
+	if !fp.Relative || from == "" {
+		return fp.get(name)
+	}
+
+	var target string
+	if fp.FS != nil {
+		target = path.Join(path.Dir(from), name)
+	} else {
+		target = filepath.Join(filepath.Dir(from), filepath.FromSlash(name))
+	}
+	if !fp.Unsafe && !fp.contains(target) {
+		return "", "", fmt.Errorf("unsafe partial name passed to FileProvider: %s", name)
+	}
+	return fp.read([]string{""}, target, name)
+}
+
+// get finds a partial by searching each of the paths.
+func (fp *FileProvider) get(name string) (string, string, error) {
 	clean := name
 	if !fp.Unsafe {
 		// Use a '/' prefix so filepath.Clean can prevent a directory traversal
@@ -40,18 +93,16 @@ func (fp *FileProvider) Get(name string) (string, error) {
 		cname = strings.ReplaceAll(filepath.Clean(cname), "\\", "/")
 		cname = strings.TrimLeft(cname, "/")
 		if cname != name || cname == "" {
-			return "", fmt.Errorf("unsafe partial name passed to FileProvider: %s", name)
+			return "", "", fmt.Errorf("unsafe partial name passed to FileProvider: %s", name)
 		}
 		clean = cname
 	}
 
-	var paths []string
-	if fp.Paths != nil {
-		paths = fp.Paths
-	} else {
-		paths = []string{""}
-	}
+	return fp.read(fp.paths(), clean, name)
+}
 
+// read reads the partial with the given cleaned name from the first of the paths it is found in.
+func (fp *FileProvider) read(paths []string, clean, name string) (string, string, error) {
 	var exts []string
 	if fp.Extensions != nil {
 		exts = fp.Extensions
@@ -59,32 +110,81 @@ func (fp *FileProvider) Get(name string) (string, error) {
 		exts = []string{"", ".mustache", ".stache"}
 	}
 
-	var f *os.File
-	var err error
-	for _, p := range paths {
-		for _, e := range exts {
-			pname := filepath.Join(p, clean+e)
-			f, err = os.Open(pname)
-			if err == nil {
-				break
-			}
-		}
-	}
-
+	f, found, tried := fp.open(paths, exts, clean)
 	if f == nil {
-		return "", fmt.Errorf("%s: partial not found", name) // nil
+		return "", "", fmt.Errorf("%s: %w (tried: %s)", name, ErrPartialNotFound, strings.Join(tried, ", "))
 	}
 	defer f.Close()
 
 	data, err := ioutil.ReadAll(f)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return string(data), nil
+	return string(data), found, nil
 }
 
-var _ PartialProvider = (*FileProvider)(nil)
+func (fp *FileProvider) paths() []string {
+	if fp.Paths != nil {
+		return fp.Paths
+	}
+	return []string{""}
+}
+
+// open returns the first file found by trying each of the extensions in each of the paths, and its path, or nil and
+// the paths it tried if there is none.
+func (fp *FileProvider) open(paths, exts []string, name string) (io.ReadCloser, string, []string) {
+	var tried []string
+	for _, p := range paths {
+		for _, e := range exts {
+			if fp.FS != nil {
+				fn := path.Join(p, name+e)
+				f, err := fp.FS.Open(fn)
+				if err == nil {
+					return f, fn, nil
+				}
+				tried = append(tried, fn)
+				continue
+			}
+			fn := filepath.Join(p, name+e)
+			f, err := os.Open(fn)
+			if err == nil {
+				return f, fn, nil
+			}
+			tried = append(tried, fn)
+		}
+	}
+	return nil, "", tried
+}
+
+// contains reports whether the path is inside one of the provider's paths.
+func (fp *FileProvider) contains(target string) bool {
+	for _, p := range fp.paths() {
+		if fp.FS != nil {
+			p, target := path.Clean(p), path.Clean(target)
+			if p == "." && target != ".." && !strings.HasPrefix(target, "../") ||
+				target == p || strings.HasPrefix(target, p+"/") {
+				return true
+			}
+			continue
+		}
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		absTarget, err := filepath.Abs(target)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(absPath, absTarget)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ RelativePartialProvider = (*FileProvider)(nil)
 
 // StaticProvider implements the PartialProvider interface by providing partials drawn from a map, which maps partial
 // name to template contents.
@@ -105,18 +205,352 @@ func (sp *StaticProvider) Get(name string) (string, error) {
 
 var _ PartialProvider = (*StaticProvider)(nil)
 
+// StrictStaticProvider is like StaticProvider, but reports a partial which isn't in its map as missing, with an error
+// wrapping ErrPartialNotFound, rather than as an empty partial.
+type StrictStaticProvider struct {
+	Partials map[string]string
+}
+
+// Get accepts the name of a partial and returns the partial's source.
+func (sp *StrictStaticProvider) Get(name string) (string, error) {
+	if data, ok := sp.Partials[name]; ok {
+		return data, nil
+	}
+	return "", fmt.Errorf("%s: %w", name, ErrPartialNotFound)
+}
+
+var _ PartialProvider = (*StrictStaticProvider)(nil)
+
 func (tmpl *Template) getPartials(partials PartialProvider, name, indent string) (*Template, error) {
-	if partials == nil {
-		return nil, errors.New("no partial provider specified")
+	data, from, err := tmpl.getPartialSource(partials, name, "")
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.preprocessor != nil {
+		if data, err = tmpl.preprocessor(name, data); err != nil {
+			return nil, &preprocessError{err}
+		}
 	}
-	data, err := partials.Get(name)
+	child, err := tmpl.compileChild(from, indentLines(data, indent))
 	if err != nil {
 		return nil, err
 	}
+	child.unindented = data
+	return child, nil
+}
+
+// A preprocessError is an error from the function set with WithPartialPreprocessor, which stops a render even when
+// other errors including partials are ignored.
+type preprocessError struct {
+	err error
+}
+
+func (e *preprocessError) Error() string {
+	return e.err.Error()
+}
+
+func (e *preprocessError) Unwrap() error {
+	return e.err
+}
+
+// getPartialSource returns the source of the named partial, with each line indented, and the name of the file it
+// came from if the provider resolves names relative to the including template.
+func (tmpl *Template) getPartialSource(partials PartialProvider, name, indent string) (string, string, error) {
+	if partials == nil {
+		return "", "", errors.New("no partial provider specified")
+	}
+	var data, from string
+	var err error
+	if rp, ok := partials.(RelativePartialProvider); ok {
+		data, from, err = rp.GetRelative(tmpl.name, name)
+	} else {
+		data, err = partials.Get(name)
+	}
+	if err != nil {
+		return "", "", err
+	}
 
-	// indent non empty lines
+	return indentLines(data, indent), from, nil
+}
+
+// indentLines adds the indent to the start of each line of data which isn't empty.
+func indentLines(data, indent string) string {
 	r := regexp.MustCompile(`(?m:^(.+)$)`)
-	data = r.ReplaceAllString(data, indent+"$1")
+	return r.ReplaceAllString(data, indent+"$1")
+}
 
-	return tmpl.parent.CompileString(data) //, partials)
+// expandTabs replaces each tab in the indentation of a partial with spaces up to the next multiple of the width, if
+// the width isn't 0.
+func expandTabs(indent string, width int) string {
+	if width <= 0 || !strings.Contains(indent, "\t") {
+		return indent
+	}
+	var b strings.Builder
+	for _, c := range indent {
+		if c == '\t' {
+			b.WriteString(strings.Repeat(" ", width-b.Len()%width))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// indented returns the template for {{>@self}}: the template itself, or if the tag is indented, the template compiled
+// again from its source, before any indentation it had as a partial, with each line indented.
+func (tmpl *Template) indented(indent string) (*Template, error) {
+	if indent == "" {
+		return tmpl, nil
+	}
+	data := tmpl.data
+	if tmpl.unindented != "" {
+		data = tmpl.unindented
+	}
+	child, err := tmpl.compileChild(tmpl.name, indentLines(data, indent))
+	if err != nil {
+		return nil, err
+	}
+	child.unindented = data
+	return child, nil
+}
+
+// hasPartial reports whether the template's partial provider has a partial with the given name which isn't empty.
+func (tmpl *Template) hasPartial(name string) bool {
+	data, _, err := tmpl.getPartialSource(tmpl.partial, name, "")
+	return err == nil && data != ""
+}
+
+// compileChild compiles the source of a partial or the output of a lambda, which is rendered with the same escape
+// mode as the template that includes it. Relative partial names in it are resolved against the given name.
+func (tmpl *Template) compileChild(name, data string) (*Template, error) {
+	child, err := tmpl.parent.compileNamed(name, data)
+	if err != nil {
+		return nil, err
+	}
+	child.outputMode = tmpl.outputMode
+	return child, nil
+}
+
+// PartialGraph records which partials a template includes, directly or through other partials.
+type PartialGraph struct {
+	// Includes maps the name of the template, which is "" unless it was compiled from a file, and the name of each
+	// partial it includes to the sorted names of the partials that they include directly. Partials which could not
+	// be found include nothing.
+	Includes map[string][]string
+	// Cycles lists the partials which include themselves, directly or indirectly. Each cycle is given as the names
+	// of the partials in it, in the order they include each other, starting and ending with the same name.
+	Cycles [][]string
+}
+
+// PartialGraph finds the partials the template includes from the given provider, directly or through other partials.
+// A RelativePartialProvider resolves the names in each partial relative to that partial, as when rendering.
+func (tmpl *Template) PartialGraph(partials PartialProvider) (*PartialGraph, error) {
+	g := &PartialGraph{Includes: map[string][]string{}}
+	var stack []string
+	var visit func(name string, t *Template) error
+	visit = func(name string, t *Template) error {
+		stack = append(stack, name)
+		defer func() { stack = stack[:len(stack)-1] }()
+		includes := partialNames(t.Tags(), nil, false)
+		raws := partialNames(t.Tags(), nil, true)
+		g.Includes[name] = partialNames(t.Tags(), append([]string(nil), raws...), false)
+		for _, inc := range includes {
+			if i := indexOf(stack, inc); i >= 0 {
+				cycle := append(append([]string{}, stack[i:]...), inc)
+				g.Cycles = append(g.Cycles, cycle)
+				continue
+			}
+			if _, ok := g.Includes[inc]; ok {
+				continue
+			}
+			child, err := t.getPartials(partials, inc, "")
+			if errors.Is(err, ErrPartialNotFound) {
+				g.Includes[inc] = nil
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", inc, err)
+			}
+			if err := visit(inc, child); err != nil {
+				return err
+			}
+		}
+		// partials included raw are not compiled, so include nothing
+		for _, raw := range raws {
+			if _, ok := g.Includes[raw]; !ok {
+				g.Includes[raw] = nil
+			}
+		}
+		return nil
+	}
+	if err := visit(tmpl.name, tmpl); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// ValidatePartials fetches and compiles each partial the template includes, directly or through other partials, to
+// catch syntax errors before rendering. The errors for all the partials which can't be fetched or compiled are returned
+// together, each with the partial's name; partials which don't exist are left to be handled when rendering.
+func (tmpl *Template) ValidatePartials() error {
+	var errs []error
+	seen := map[string]bool{}
+	var visit func(t *Template)
+	visit = func(t *Template) {
+		for _, name := range partialNames(t.Tags(), nil, false) {
+			child, err := t.getPartials(tmpl.partial, name, "")
+			if errors.Is(err, ErrPartialNotFound) {
+				continue
+			}
+			key := name
+			if child != nil && child.name != "" {
+				key = child.name
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			visit(child)
+		}
+	}
+	visit(tmpl)
+	return joinErrors(errs...)
+}
+
+// BakePartials compiles a template and fetches the source of each partial it includes, directly or through other
+// partials, returning a StaticProvider holding them by name, so that the template can be rendered without reading
+// files. Cycles of partials, and partials which don't exist unless they are only ever optional, are errors.
+func (r *Compiler) BakePartials(data string, partials PartialProvider) (*StaticProvider, error) {
+	tmpl, err := r.CompileString(data)
+	if err != nil {
+		return nil, err
+	}
+	sp := &StaticProvider{Partials: map[string]string{}}
+	var missing, stack []string
+	froms := map[string]string{}
+	compiled := map[string]bool{}
+	var visit func(t *Template) error
+	visit = func(t *Template) error {
+		for _, elem := range partialElements(t.Tags(), nil) {
+			name := elem.name
+			if i := indexOf(stack, name); i >= 0 && !elem.raw {
+				cycle := append(append([]string{}, stack[i:]...), name)
+				return fmt.Errorf("partial cycle: %s", strings.Join(cycle, " > "))
+			}
+			src, from, err := t.getPartialSource(partials, name, "")
+			if errors.Is(err, ErrPartialNotFound) {
+				if !elem.optional {
+					missing = insertName(missing, name)
+				}
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			// a StaticProvider has one partial for each name, so a name a relative provider resolves to two files
+			// can't be baked
+			if prev, ok := froms[name]; ok && prev != from {
+				return fmt.Errorf("%s: included as both %s and %s", name, prev, from)
+			}
+			froms[name] = from
+			sp.Partials[name] = src
+			if elem.raw || compiled[name] {
+				continue
+			}
+			compiled[name] = true
+			child, err := t.compileChild(from, src)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			stack = append(stack, name)
+			err = visit(child)
+			stack = stack[:len(stack)-1]
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(tmpl); err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: %w", strings.Join(missing, ", "), ErrPartialNotFound)
+	}
+	return sp, nil
+}
+
+// partialElements adds the partial tags among the tags, and their children, to elems, leaving out {{>@self}}.
+func partialElements(tags []Tag, elems []*partialElement) []*partialElement {
+	for _, tag := range tags {
+		switch tag.Type() {
+		case Partial:
+			if pe, ok := tag.(*partialElement); ok && pe.name != selfPartial {
+				elems = append(elems, pe)
+			}
+		case Section, InvertedSection:
+			elems = partialElements(tag.Tags(), elems)
+		}
+	}
+	return elems
+}
+
+// Dependents returns the sorted names of the templates and partials in the graph which include the named partial,
+// directly or indirectly, and so must be rendered again if it changes.
+func (g *PartialGraph) Dependents(name string) []string {
+	found := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		for from, includes := range g.Includes {
+			if !found[from] && indexOf(includes, name) >= 0 {
+				found[from] = true
+				visit(from)
+			}
+		}
+	}
+	visit(name)
+	names := make([]string, 0, len(found))
+	for from := range found {
+		names = append(names, from)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// partialNames adds the names of the partials among the tags, and their children, which are included raw or not, to
+// names, which is kept sorted and free of duplicates.
+func partialNames(tags []Tag, names []string, raw bool) []string {
+	for _, tag := range tags {
+		switch tag.Type() {
+		case Partial:
+			if pe, ok := tag.(*partialElement); ok && pe.raw == raw && pe.name != selfPartial {
+				names = insertName(names, tag.Name())
+			}
+		case Section, InvertedSection:
+			names = partialNames(tag.Tags(), names, raw)
+		}
+	}
+	return names
+}
+
+// insertName adds name to the sorted names, unless it is already there.
+func insertName(names []string, name string) []string {
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		names = append(names, "")
+		copy(names[i+1:], names[i:])
+		names[i] = name
+	}
+	return names
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
 }
@@ -0,0 +1,174 @@
+package mustache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TemplateSet is a collection of compiled templates, loaded from the files in a directory, which are rendered by
+// name.
+type TemplateSet struct {
+	templates map[string]*Template
+}
+
+// LoadDir compiles each file in the given directory of the filesystem whose name ends with one of the extensions,
+// which default to ".mustache". Each template is named for its file, without the directory or extension. Unless
+// the compiler has been given a PartialProvider, the templates in the set can include each other as partials by the
+// same names. If any file fails to compile, the errors for all of them are returned together.
+func (r *Compiler) LoadDir(fsys fs.FS, dir string, exts ...string) (*TemplateSet, error) {
+	if len(exts) == 0 {
+		exts = []string{".mustache"}
+	}
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]string{}
+	files := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := path.Ext(entry.Name())
+		if !hasExtension(exts, ext) {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		filename := path.Join(dir, entry.Name())
+		if other, ok := files[name]; ok {
+			return nil, fmt.Errorf("%s: template %s is already loaded from %s", filename, name, other)
+		}
+		data, err := fs.ReadFile(fsys, filename)
+		if err != nil {
+			return nil, err
+		}
+		sources[name] = string(data)
+		files[name] = filename
+	}
+
+	compiler := *r
+	if compiler.partial == nil {
+		compiler.partial = &StaticProvider{Partials: sources}
+	}
+	set := &TemplateSet{templates: map[string]*Template{}}
+	var errs []error
+	for _, name := range sortedNames(files) {
+		filename := files[name]
+		tmpl, err := compiler.compileFile(filename, path.Ext(filename), sources[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filename, err))
+			continue
+		}
+		set.templates[name] = tmpl
+	}
+	if len(errs) > 0 {
+		return nil, joinErrors(errs...)
+	}
+	return set, nil
+}
+
+func hasExtension(exts []string, ext string) bool {
+	for _, e := range exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the named template, or nil if there is no template with that name in the set.
+func (set *TemplateSet) Lookup(name string) *Template {
+	return set.templates[name]
+}
+
+// Names returns the names of the templates in the set, in sorted order.
+func (set *TemplateSet) Names() []string {
+	names := make([]string, 0, len(set.templates))
+	for name := range set.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Frender renders the named template to an io.Writer using the given data source.
+func (set *TemplateSet) Frender(out io.Writer, name string, context ...interface{}) error {
+	tmpl, ok := set.templates[name]
+	if !ok {
+		return fmt.Errorf("no template named %q in set", name)
+	}
+	return tmpl.Frender(out, context...)
+}
+
+// Render renders the named template using the given data source and returns the output.
+func (set *TemplateSet) Render(name string, context ...interface{}) (string, error) {
+	tmpl, ok := set.templates[name]
+	if !ok {
+		return "", fmt.Errorf("no template named %q in set", name)
+	}
+	return tmpl.Render(context...)
+}
+
+// joinErrors returns an error holding the errors which aren't nil, or nil if there are none, as errors.Join does in
+// the versions of Go which have it. Its message is theirs, one on each line, and errors.Is and errors.As look at each.
+func joinErrors(errs ...error) error {
+	var joined []error
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+	if len(joined) == 0 {
+		return nil
+	}
+	return &joinError{joined}
+}
+
+type joinError struct {
+	errs []error
+}
+
+func (e *joinError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *joinError) Unwrap() []error {
+	return e.errs
+}
+
+func (e *joinError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *joinError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+//go:build go1.21
+// +build go1.21
+
+package mustache
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// A *slog.Logger satisfies Logger, so it can be passed to WithLogger directly.
+var _ Logger = (*slog.Logger)(nil)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	tmpl, err := New().WithLogger(logger).CompileString(`{{missing}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Render(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "level=DEBUG") {
+		t.Errorf("expected a debug event, got %q", buf.String())
+	}
+}
+
+func BenchmarkRenderLogger(b *testing.B) {
+	benchmarkRender(b, New().WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+}
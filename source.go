@@ -0,0 +1,339 @@
+package mustache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// String returns the source of the template in a canonical form, reconstructed from the parsed template, so templates
+// which differ only in their formatting can be compared. Whitespace inside tags is normalized, so {{ name }} becomes
+// {{name}}, raw values are written as {{{name}}}, and comments are dropped. Define blocks are written at the start,
+// in order of name. Set delimiter tags are kept, and the tags after them written with the new delimiters. A tag which
+// stood alone on its line is written on a line of its own, without its indentation unless it is a partial.
+//
+// Compiling the result with the same compiler gives an equivalent template, whose String method returns the same
+// source. Where dropping a comment would otherwise change which tags stand alone on their lines, an empty comment is
+// written in its place.
+func (tmpl *Template) String() string {
+	w := sourceWriter{otag: "{{", ctag: "}}", forceRaw: tmpl.forceRaw}
+	names := make([]string, 0, len(tmpl.defines))
+	for name := range tmpl.defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.section(&sectionElement{name: name, helper: defineHelper, elems: tmpl.defines[name]})
+	}
+	w.elements(tmpl.elems)
+	return w.String()
+}
+
+// A sourceToken is a piece of text or a tag in the source written by Template.String.
+type sourceToken struct {
+	text       string // The text, or the whole tag including its delimiters
+	tag        bool
+	standalone bool   // Whether the tag is one which is removed with its line when it stands alone on it
+	partial    bool   // Whether the tag includes a partial
+	indent     string // The indentation of a partial
+	comment    string // An empty comment, in the delimiters of the tag
+}
+
+// A sourceWriter reconstructs the source of parsed template elements.
+type sourceWriter struct {
+	tokens   []sourceToken
+	otag     string
+	ctag     string
+	forceRaw bool
+}
+
+func (w *sourceWriter) text(s string) {
+	w.tokens = append(w.tokens, sourceToken{text: s})
+}
+
+func (w *sourceWriter) tag(s string, standalone bool) *sourceToken {
+	w.tokens = append(w.tokens, sourceToken{
+		text:       w.otag + s + w.ctag,
+		tag:        true,
+		standalone: standalone,
+		comment:    w.otag + "!" + w.ctag,
+	})
+	return &w.tokens[len(w.tokens)-1]
+}
+
+func (w *sourceWriter) elements(elems []interface{}) {
+	for _, element := range elems {
+		switch elem := element.(type) {
+		case *textElement:
+			w.text(string(elem.text))
+		case *varElement:
+			if elem.raw && !w.forceRaw {
+				w.tag("{"+elem.tagText()+"}", false)
+			} else {
+				w.tag(elem.tagText(), false)
+			}
+		case *sectionElement:
+			w.section(elem)
+		case *partialElement:
+			name := elem.name
+			if elem.raw {
+				name = "&" + name
+			}
+			if elem.optional {
+				name = "?" + name
+			}
+			if elem.context != "" {
+				name += " " + elem.context
+			}
+			t := w.tag(">"+name, true)
+			t.partial, t.indent = true, elem.indent
+		case *delimElement:
+			w.tag("="+elem.otag+" "+elem.ctag+"=", true)
+			w.otag, w.ctag = elem.otag, elem.ctag
+		}
+	}
+}
+
+func (w *sourceWriter) section(se *sectionElement) {
+	if se.inverted {
+		w.tag("^"+se.tagText(), true)
+	} else {
+		w.tag("#"+se.tagText(), true)
+	}
+	w.elements(se.elems)
+	if se.inverse != nil {
+		w.tag("else", true)
+		w.elements(se.inverse)
+	}
+	w.tag("/"+se.closingName(), true)
+}
+
+// String writes the tokens, placing the tags which stood alone on their lines on lines of their own, and making sure
+// no other tag is taken to stand alone when the source is parsed again.
+func (w *sourceWriter) String() string {
+	var b strings.Builder
+	line, tagged := "", false // The text of the current line so far, and whether it has a tag
+	for i, t := range w.tokens {
+		if !t.tag {
+			b.WriteString(t.text)
+			if n := strings.LastIndexByte(t.text, '\n'); n >= 0 {
+				line, tagged = t.text[n+1:], false
+			} else {
+				line += t.text
+			}
+			continue
+		}
+		mayStandalone := t.standalone && !tagged && strings.Trim(line, " \t") == ""
+		if mayStandalone && line == "" {
+			b.WriteString(t.indent + t.text + "\n")
+			continue
+		}
+		if mayStandalone && t.partial && t.indent != line {
+			// A partial is indented by the whitespace before it.
+			b.WriteString(t.comment)
+			mayStandalone = false
+		}
+		b.WriteString(t.text)
+		if mayStandalone && standsAlone(w.tokens[i+1:]) {
+			b.WriteString(t.comment)
+		}
+		tagged = true
+	}
+	return b.String()
+}
+
+// standsAlone reports whether a tag followed by the given tokens, at the start of a line or after only whitespace,
+// would stand alone on the line.
+func standsAlone(tokens []sourceToken) bool {
+	var text string
+	for len(tokens) > 0 && !tokens[0].tag {
+		text += tokens[0].text
+		tokens = tokens[1:]
+	}
+	if text == "" {
+		return len(tokens) == 0
+	}
+	text = strings.TrimLeft(text, " \t")
+	return strings.HasPrefix(text, "\n") || strings.HasPrefix(text, "\r\n")
+}
+
+// tagText returns the contents of the tag for the variable, without any raw markers, with the whitespace normalized.
+func (e *varElement) tagText() string {
+	if e.helper == "" {
+		return e.name
+	}
+	text := e.helper
+	if !e.fn.IsValid() {
+		text += " " + e.name
+	}
+	for _, arg := range e.args {
+		text += " " + arg.String()
+	}
+	return text
+}
+
+// tagText returns the contents of the tag opening the section, without the # or ^, with the whitespace normalized.
+func (e *sectionElement) tagText() string {
+	if e.alias != "" {
+		return e.openingText() + " as " + e.alias
+	}
+	return e.openingText()
+}
+
+// openingText returns the contents of the tag opening the section without any as clause.
+func (e *sectionElement) openingText() string {
+	switch {
+	case e.helper == "":
+		return e.name
+	case e.helper == defineHelper:
+		if strings.IndexFunc(e.name, unicode.IsSpace) >= 0 || strings.ContainsAny(e.name, "\"`") {
+			return e.helper + " " + strconv.Quote(e.name)
+		}
+		return e.helper + " " + e.name
+	case e.args != nil:
+		text := e.helper
+		for _, arg := range e.args {
+			text += " " + arg.String()
+		}
+		return text
+	default:
+		return e.helper + " " + e.name
+	}
+}
+
+// Equal reports whether two templates have the same parsed structure: the same text, tags, sections, partials, define
+// blocks and delimiters, so templates which differ only in formatting, such as {{ x }} and {{x}}, or in comments, are
+// equal. The compiler options the templates were compiled with are not compared.
+func (tmpl *Template) Equal(other *Template) bool {
+	if tmpl == nil || other == nil {
+		return tmpl == other
+	}
+	if len(tmpl.defines) != len(other.defines) {
+		return false
+	}
+	for name, elems := range tmpl.defines {
+		if otherElems, ok := other.defines[name]; !ok || !equalElements(elems, otherElems) {
+			return false
+		}
+	}
+	return equalElements(tmpl.elems, other.elems)
+}
+
+// equalElements reports whether two lists of elements are the same, joining adjacent text.
+func equalElements(a, b []interface{}) bool {
+	a, b = joinText(a), joinText(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !equalElement(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// joinText returns the elements with adjacent text elements joined together, and empty ones removed.
+func joinText(elems []interface{}) []interface{} {
+	joined := make([]interface{}, 0, len(elems))
+	var text []byte
+	for _, element := range elems {
+		if elem, ok := element.(*textElement); ok {
+			text = append(text, elem.text...)
+			continue
+		}
+		if len(text) > 0 {
+			joined = append(joined, &textElement{text})
+			text = nil
+		}
+		joined = append(joined, element)
+	}
+	if len(text) > 0 {
+		joined = append(joined, &textElement{text})
+	}
+	return joined
+}
+
+func equalElement(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *textElement:
+		b, ok := b.(*textElement)
+		return ok && string(a.text) == string(b.text)
+	case *varElement:
+		b, ok := b.(*varElement)
+		return ok && a.tagText() == b.tagText() && a.raw == b.raw && a.fn.IsValid() == b.fn.IsValid()
+	case *sectionElement:
+		b, ok := b.(*sectionElement)
+		return ok && a.tagText() == b.tagText() && a.helper == b.helper && a.inverted == b.inverted &&
+			(a.args == nil) == (b.args == nil) && equalElements(a.elems, b.elems) &&
+			(a.inverse == nil) == (b.inverse == nil) && equalElements(a.inverse, b.inverse)
+	case *partialElement:
+		b, ok := b.(*partialElement)
+		return ok && a.name == b.name && a.context == b.context && a.optional == b.optional && a.raw == b.raw &&
+			a.indent == b.indent
+	case *delimElement:
+		b, ok := b.(*delimElement)
+		return ok && *a == *b
+	}
+	return false
+}
+
+// Fingerprint returns a hash of the structure of the template, as a string of hex digits, for use in cache keys and
+// ETags. It is the SHA-256 hash of the canonical source returned by String, so templates which differ only in the
+// whitespace inside their tags or in their comments have the same fingerprint, while any change to their text or tags
+// changes it. The partials the template includes are not fetched; see FingerprintPartials.
+func (tmpl *Template) Fingerprint() string {
+	sum := sha256.Sum256([]byte(tmpl.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// FingerprintPartials is like Fingerprint, but the hash also covers the partials the template includes, directly or
+// through other partials, fetched from the partial provider it was compiled with, so that it changes when one of them
+// does. Partials which don't exist are hashed as missing. An error fetching or compiling a partial is returned.
+func (tmpl *Template) FingerprintPartials() (string, error) {
+	h := sha256.New()
+	h.Write([]byte(tmpl.String()))
+	seen := map[string]bool{}
+	var visit func(t *Template) error
+	visit = func(t *Template) error {
+		for _, name := range partialNames(t.Tags(), nil, true) {
+			data, _, err := t.getPartialSource(tmpl.partial, name, "")
+			if err != nil && !errors.Is(err, ErrPartialNotFound) {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Fprintf(h, "\x00&%s\x00%t\x00%s", name, err == nil, data)
+		}
+		for _, name := range partialNames(t.Tags(), nil, false) {
+			child, err := t.getPartials(tmpl.partial, name, "")
+			if errors.Is(err, ErrPartialNotFound) {
+				fmt.Fprintf(h, "\x00>%s\x00false", name)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			key := name
+			if child.name != "" {
+				key = child.name
+			}
+			fmt.Fprintf(h, "\x00>%s\x00true\x00%s", key, child.String())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(tmpl); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}